@@ -0,0 +1,131 @@
+package checker
+
+import "sort"
+
+/*
+	Checks that a history of writes and reads is causally consistent
+	- the causal order puts each client's operations in the order it
+	  called them, and a write before every read returning its value
+	- the causal order has no cycles and every read returns a value
+	  written to its key, or the empty value of a missing key
+	- a read never returns a write overwritten by another write causally
+	  before the read, this covers read your writes, monotonic reads,
+	  monotonic writes and writes follow reads
+	- concurrent writes may be seen in any order
+	- written values are unique per key, only deletes share the empty value
+	- a failed write may have taken effect or not, it never counts
+	  as overwriting another one
+*/
+func CheckCausal(history []Operation) Result {
+	if causal(history) {
+		return Result{Ok: true, Check: "causally consistent"}
+	}
+	return Result{Check: "causally consistent", Counterexample: shrink(history, causal)}
+}
+
+func causal(ops []Operation) bool {
+	n := len(ops)
+	// before[j] holds every operation causally before operation j
+	before := make([]bitset, n)
+	for i := range before {
+		before[i] = newBitset(n)
+	}
+
+	// program order
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		if ops[order[a]].Client != ops[order[b]].Client {
+			return ops[order[a]].Client < ops[order[b]].Client
+		}
+		return ops[order[a]].Call < ops[order[b]].Call
+	})
+	for i := 1; i < n; i++ {
+		if ops[order[i-1]].Client == ops[order[i]].Client {
+			before[order[i]].set(order[i-1])
+		}
+	}
+
+	// writes of every key by value, deletes share the empty value
+	writes := map[string]map[string][]int{}
+	for i, op := range ops {
+		if op.Kind != Write {
+			continue
+		}
+		if writes[op.Key] == nil {
+			writes[op.Key] = map[string][]int{}
+		}
+		writes[op.Key][op.Value] = append(writes[op.Key][op.Value], i)
+	}
+
+	// reads from, a read of the empty value may come from any delete
+	// or the missing key, so it adds no order
+	for i, op := range ops {
+		if op.Kind != Read || op.Value == "" {
+			continue
+		}
+		from := writes[op.Key][op.Value]
+		if len(from) == 0 {
+			// a value nobody wrote
+			return false
+		}
+		before[i].set(from[0])
+	}
+
+	// transitive closure
+	for k := 0; k < n; k++ {
+		for i := 0; i < n; i++ {
+			if before[i].has(k) {
+				before[i].or(before[k])
+			}
+		}
+	}
+	for i := 0; i < n; i++ {
+		if before[i].has(i) {
+			return false
+		}
+	}
+
+	// a write is overwritten before the read if a completed write to the
+	// key is causally after it and before the read, -1 is the missing key
+	overwritten := func(w, r int) bool {
+		for _, values := range writes[ops[r].Key] {
+			for _, other := range values {
+				if other == w || ops[other].Pending() || !before[r].has(other) {
+					continue
+				}
+				if w == -1 || before[other].has(w) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	for r, op := range ops {
+		if op.Kind != Read {
+			continue
+		}
+		sources := writes[op.Key][op.Value]
+		if op.Value == "" {
+			sources = append([]int{-1}, sources...)
+		}
+		ok := false
+		for _, w := range sources {
+			// a delete causally after the read can not be its source
+			if w != -1 && before[w].has(r) {
+				continue
+			}
+			if !overwritten(w, r) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
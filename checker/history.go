@@ -0,0 +1,190 @@
+package checker
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dist-kv/services"
+)
+
+// kinds of recorded operations
+const (
+	Write = "write"
+	Read  = "read"
+)
+
+// Operation is one client operation of a history
+// a delete is recorded as a write of the empty value, the value a
+// missing key reads as
+type Operation struct {
+	Client int
+	Kind   string
+	Key    string
+	Value  string // written, or returned by a read
+	Call   int64  // nanoseconds since the recorder started
+	Return int64  // pending forever if the write failed, it may still take effect
+}
+
+// the operation never returned, it may take effect at any point after its call
+func (op Operation) Pending() bool {
+	return op.Return == math.MaxInt64
+}
+
+func (op Operation) String() string {
+	ret := "..."
+	if !op.Pending() {
+		ret = fmt.Sprintf("%.3fms", float64(op.Return)/1e6)
+	}
+	return fmt.Sprintf("client %d  %-5s %s = %q  [%.3fms, %s]",
+		op.Client, op.Kind, op.Key, op.Value, float64(op.Call)/1e6, ret)
+}
+
+/*
+	Recorder captures the operations of a set of clients as a history
+	- every operation gets the time it was invoked and the time it returned
+	- times come from one monotonic clock, so operations of different
+	  clients can be compared
+*/
+type Recorder struct {
+	mu    sync.Mutex
+	start time.Time
+	ops   []Operation
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{start: time.Now()}
+}
+
+// wraps the client, its operations are recorded under the id
+func (r *Recorder) Client(id int, client *services.Client) *Client {
+	return &Client{Id: id, client: client, recorder: r}
+}
+
+// the recorded operations in the order they returned
+func (r *Recorder) History() []Operation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Operation{}, r.ops...)
+}
+
+func (r *Recorder) now() int64 {
+	return time.Since(r.start).Nanoseconds()
+}
+
+func (r *Recorder) record(op Operation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ops = append(r.ops, op)
+}
+
+// Client is a services.Client recording every write, delete and read
+type Client struct {
+	Id       int
+	client   *services.Client
+	recorder *Recorder
+}
+
+func (c *Client) Write(key, value string) error {
+	call := c.recorder.now()
+	_, err := c.client.Write(key, value)
+	c.recordWrite(key, value, call, err)
+	return err
+}
+
+func (c *Client) Delete(key string) error {
+	call := c.recorder.now()
+	err := c.client.Delete(key)
+	c.recordWrite(key, "", call, err)
+	return err
+}
+
+// a failed read returned nothing and is left out of the history
+func (c *Client) Read(key string) (string, error) {
+	call := c.recorder.now()
+	value, _, err := c.client.Read(key)
+	if err != nil {
+		return "", err
+	}
+	// some modes report a missing key as nil
+	if value == "nil" {
+		value = ""
+	}
+	c.recorder.record(Operation{
+		Client: c.Id,
+		Kind:   Read,
+		Key:    key,
+		Value:  value,
+		Call:   call,
+		Return: c.recorder.now(),
+	})
+	return value, nil
+}
+
+func (c *Client) recordWrite(key, value string, call int64, err error) {
+	ret := c.recorder.now()
+	if err != nil {
+		ret = math.MaxInt64
+	}
+	c.recorder.record(Operation{
+		Client: c.Id,
+		Kind:   Write,
+		Key:    key,
+		Value:  value,
+		Call:   call,
+		Return: ret,
+	})
+}
+
+// the operations on every key, keys in order
+func byKey(history []Operation) ([]string, map[string][]Operation) {
+	ops := map[string][]Operation{}
+	for _, op := range history {
+		ops[op.Key] = append(ops[op.Key], op)
+	}
+	keys := make([]string, 0, len(ops))
+	for key := range ops {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, ops
+}
+
+// the operations of every client in the order it called them, clients in order
+// a client waits for each operation before calling the next
+func byClient(history []Operation) [][]Operation {
+	ops := map[int][]Operation{}
+	for _, op := range history {
+		ops[op.Client] = append(ops[op.Client], op)
+	}
+	ids := make([]int, 0, len(ops))
+	for id := range ops {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	clients := make([][]Operation, len(ids))
+	for i, id := range ids {
+		clients[i] = ops[id]
+		sort.SliceStable(clients[i], func(a, b int) bool {
+			return clients[i][a].Call < clients[i][b].Call
+		})
+	}
+	return clients
+}
+
+// one operation per line in call order
+func format(ops []Operation) string {
+	sorted := append([]Operation{}, ops...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Call < sorted[j].Call
+	})
+	lines := make([]string, len(sorted))
+	for i, op := range sorted {
+		lines[i] = "  " + op.String()
+	}
+	return strings.Join(lines, "\n")
+}
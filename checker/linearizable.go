@@ -0,0 +1,265 @@
+package checker
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Result of checking a history
+type Result struct {
+	Ok    bool
+	Check string // the guarantee checked
+	Key   string // key whose history failed, empty if it spans keys
+	// the smallest part of the history that still fails
+	Counterexample []Operation
+}
+
+func (r Result) String() string {
+	if r.Ok {
+		return "history is " + r.Check
+	}
+	of := ""
+	if r.Key != "" {
+		of = " of " + r.Key
+	}
+	return fmt.Sprintf("history%s is not %s, counterexample:\n%s", of, r.Check, format(r.Counterexample))
+}
+
+/*
+	Checks that a history of writes and reads on registers is linearizable
+	- keys are independent registers, each one is checked on its own
+	- a key reads as the empty value until it is written
+	- the search follows Wing & Gong with the state cache of Lowe:
+	  operations are linearized one at a time in an order consistent with
+	  real time, backtracking when a read can not return its value
+	- a failing history is shrunk to a counterexample where dropping any
+	  other operation makes it linearizable
+*/
+func CheckLinearizable(history []Operation) Result {
+	keys, ops := byKey(history)
+	for _, key := range keys {
+		if !linearizable(ops[key]) {
+			return Result{Check: "linearizable", Key: key, Counterexample: shrink(ops[key], linearizable)}
+		}
+	}
+	return Result{Ok: true, Check: "linearizable"}
+}
+
+// a call or return of an operation, events are linked in time order
+type event struct {
+	op    int
+	call  bool
+	match *event // the return of a call
+	prev  *event
+	next  *event
+}
+
+// links the calls and returns of the operations in time order
+// calls go first at equal times, the operations count as overlapping
+func link(ops []Operation) *event {
+	events := make([]*event, 0, 2*len(ops))
+	for i := range ops {
+		call := &event{op: i, call: true}
+		call.match = &event{op: i}
+		events = append(events, call, call.match)
+	}
+	time := func(e *event) int64 {
+		if e.call {
+			return ops[e.op].Call
+		}
+		return ops[e.op].Return
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if time(events[i]) != time(events[j]) {
+			return time(events[i]) < time(events[j])
+		}
+		return events[i].call && !events[j].call
+	})
+
+	head := &event{}
+	prev := head
+	for _, e := range events {
+		prev.next = e
+		e.prev = prev
+		prev = e
+	}
+	return head
+}
+
+// takes the call and its return out of the list
+func lift(call *event) {
+	call.prev.next = call.next
+	call.next.prev = call.prev
+	ret := call.match
+	ret.prev.next = ret.next
+	if ret.next != nil {
+		ret.next.prev = ret.prev
+	}
+}
+
+// puts a lifted call and its return back
+func unlift(call *event) {
+	ret := call.match
+	ret.prev.next = ret
+	if ret.next != nil {
+		ret.next.prev = ret
+	}
+	call.prev.next = call
+	call.next.prev = call
+}
+
+// applies the operation to the register, false if a read does not match
+func step(state string, op Operation) (string, bool) {
+	if op.Kind == Write {
+		return op.Value, true
+	}
+	return state, op.Value == state
+}
+
+func linearizable(ops []Operation) bool {
+	head := link(ops)
+	linearized := newBitset(len(ops))
+	// linearized sets already explored, with the state they ended in
+	seen := newStateCache()
+
+	type frame struct {
+		call  *event
+		state string
+	}
+	var calls []frame
+	state := ""
+
+	e := head.next
+	for head.next != nil {
+		if e.call {
+			next, ok := step(state, ops[e.op])
+			if ok && seen.add(linearized.with(e.op), next) {
+				calls = append(calls, frame{e, state})
+				state = next
+				linearized.set(e.op)
+				lift(e)
+				e = head.next
+			} else {
+				e = e.next
+			}
+			continue
+		}
+
+		// an operation returned before any order could include it
+		if len(calls) == 0 {
+			return false
+		}
+		top := calls[len(calls)-1]
+		calls = calls[:len(calls)-1]
+		state = top.state
+		linearized.clear(top.call.op)
+		unlift(top.call)
+		e = top.call.next
+	}
+	return true
+}
+
+// drops operations while the rest still fails the check
+// a write is only dropped once no read returns its value, so the
+// counterexample never blames a write it left out
+func shrink(ops []Operation, ok func([]Operation) bool) []Operation {
+	for dropped := true; dropped; {
+		dropped = false
+		for i := range ops {
+			if ops[i].Kind == Write && readsValue(ops, ops[i].Value) {
+				continue
+			}
+			rest := append(append([]Operation{}, ops[:i]...), ops[i+1:]...)
+			if !ok(rest) {
+				ops = rest
+				dropped = true
+				break
+			}
+		}
+	}
+	return ops
+}
+
+func readsValue(ops []Operation, value string) bool {
+	for _, op := range ops {
+		if op.Kind == Read && op.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// a set of operation indexes
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int) {
+	b[i/64] |= 1 << (i % 64)
+}
+
+func (b bitset) clear(i int) {
+	b[i/64] &^= 1 << (i % 64)
+}
+
+func (b bitset) has(i int) bool {
+	return b[i/64]&(1<<(i%64)) != 0
+}
+
+// adds every index of other
+func (b bitset) or(other bitset) {
+	for i := range b {
+		b[i] |= other[i]
+	}
+}
+
+// a copy with i set
+func (b bitset) with(i int) bitset {
+	c := append(bitset{}, b...)
+	c.set(i)
+	return c
+}
+
+func (b bitset) equal(other bitset) bool {
+	for i := range b {
+		if b[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bitset) hash() uint64 {
+	h := uint64(14695981039346656037)
+	for _, w := range b {
+		h ^= w
+		h *= 1099511628211
+	}
+	return h
+}
+
+// the sets of linearized operations explored so far and their states
+type stateCache map[uint64][]cachedState
+
+type cachedState struct {
+	linearized bitset
+	state      string
+}
+
+func newStateCache() stateCache {
+	return stateCache{}
+}
+
+// false if the set was already explored ending in the same state
+func (c stateCache) add(linearized bitset, state string) bool {
+	h := linearized.hash()
+	for _, s := range c[h] {
+		if s.state == state && s.linearized.equal(linearized) {
+			return false
+		}
+	}
+	c[h] = append(c[h], cachedState{linearized, state})
+	return true
+}
@@ -0,0 +1,142 @@
+package checker
+
+import (
+	"strconv"
+	"strings"
+)
+
+/*
+	Checks that a history of writes and reads is sequentially consistent
+	- there is one total order of every operation, each client's operations
+	  in the order it called them, where every read returns the latest write
+	- real time is ignored, a read may return a value long overwritten
+	  as long as every client agrees on the order
+	- unlike linearizability the keys are not independent, the order
+	  covers the whole history at once
+	- a failed write may take effect at any point after the operations
+	  its client called before it, or never
+*/
+func CheckSequential(history []Operation) Result {
+	if sequential(history) {
+		return Result{Ok: true, Check: "sequentially consistent"}
+	}
+	return Result{Check: "sequentially consistent", Counterexample: shrink(history, sequential)}
+}
+
+// a failed write and how many operations its client called before it
+type floatingWrite struct {
+	op     Operation
+	client int
+	after  int
+}
+
+func sequential(history []Operation) bool {
+	clients := byClient(history)
+	var floating []floatingWrite
+	for c, ops := range clients {
+		called := []Operation{}
+		for _, op := range ops {
+			if op.Kind == Write && op.Pending() {
+				floating = append(floating, floatingWrite{op, c, len(called)})
+			} else {
+				called = append(called, op)
+			}
+		}
+		clients[c] = called
+	}
+
+	keys, _ := byKey(history)
+	index := map[string]int{}
+	for i, key := range keys {
+		index[key] = i
+	}
+
+	// next operation of every client, floating writes taken and the value of every key
+	pos := make([]int, len(clients))
+	taken := newBitset(len(floating))
+	state := make([]string, len(keys))
+	// states already explored, none of them led to a full order
+	seen := map[string]bool{}
+
+	// orders the rest of the history, pos is left as it was on failure
+	var search func() bool
+	search = func() bool {
+		entry := append([]int{}, pos...)
+
+		// a read matching the state can go right away, it changes nothing
+		// the other clients could need
+		for progress := true; progress; {
+			progress = false
+			for c, ops := range clients {
+				if pos[c] < len(ops) && ops[pos[c]].Kind == Read && state[index[ops[pos[c]].Key]] == ops[pos[c]].Value {
+					pos[c]++
+					progress = true
+				}
+			}
+		}
+
+		done := true
+		for c, ops := range clients {
+			if pos[c] < len(ops) {
+				done = false
+			}
+		}
+		if done {
+			return true
+		}
+
+		at := searchState(pos, taken, state)
+		if !seen[at] {
+			seen[at] = true
+
+			// the next write of some client goes next, or a floating one
+			for c, ops := range clients {
+				if pos[c] == len(ops) || ops[pos[c]].Kind != Write {
+					continue
+				}
+				k := index[ops[pos[c]].Key]
+				prev := state[k]
+				state[k] = ops[pos[c]].Value
+				pos[c]++
+				if search() {
+					return true
+				}
+				pos[c]--
+				state[k] = prev
+			}
+			for i, f := range floating {
+				if taken.has(i) || pos[f.client] < f.after {
+					continue
+				}
+				k := index[f.op.Key]
+				prev := state[k]
+				state[k] = f.op.Value
+				taken.set(i)
+				if search() {
+					return true
+				}
+				taken.clear(i)
+				state[k] = prev
+			}
+		}
+
+		copy(pos, entry)
+		return false
+	}
+	return search()
+}
+
+// key of a search state in the cache of explored ones
+func searchState(pos []int, taken bitset, state []string) string {
+	var b strings.Builder
+	for _, p := range pos {
+		b.WriteString(strconv.Itoa(p))
+		b.WriteByte(',')
+	}
+	for _, w := range taken {
+		b.WriteString(strconv.FormatUint(w, 16))
+		b.WriteByte(',')
+	}
+	b.WriteString(strings.Join(state, "\x00"))
+	return b.String()
+}
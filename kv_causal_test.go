@@ -1,12 +1,14 @@
 package distkv
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"sync"
 	"testing"
 	"time"
 
+	"dist-kv/checker"
 	"dist-kv/services"
 )
 
@@ -28,40 +30,118 @@ func TestCausality(t *testing.T) {
 		clients[i].Init(Cfg.ClientPorts[i], true)
 	}
 
-	// broadcast takes around 5ms time for second node
-	// 25ms for third node
+	// broadcast takes around 2ms to the second node
+	// and 4ms to the third, see the latency model in config.json
 	clients[0].Write("x", "1")
 
 	// wait 11 seconds to get updated x
 	time.Sleep(time.Millisecond * 6)
-	clients[1].Read("x")
+	x1, _, _ := clients[1].Read("x")
 	clients[1].Write("y", "1")
 
 	// if y is read as 1, x must be 1
 	time.Sleep(time.Millisecond * 60)
-	clients[2].Read("y")
-	clients[2].Read("x")
+	y2, _, _ := clients[2].Read("y")
+	x2, _, _ := clients[2].Read("x")
+	if x1 == "1" && y2 == "1" && x2 != "1" {
+		t.Fatalf("Read y = 1 before the write x = 1 it depends on")
+	}
 }
 
-func TestCausalityConcurrency(t *testing.T) {
-	// testing with three clients
+func TestCausalDependencyChain(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{}
+		clients[i].Init(Cfg.ClientPorts[i], true)
+	}
+
+	// a chain across several keys and servers
+	clients[0].Write("c1", "1")
+	time.Sleep(time.Millisecond * 50)
+	if v, _, _ := clients[1].Read("c1"); v != "1" {
+		t.Fatalf("Write c1 did not reach server 2")
+	}
+	clients[1].Write("c2", "1")
+	time.Sleep(time.Millisecond * 50)
+	if v, _, _ := clients[2].Read("c2"); v != "1" {
+		t.Fatalf("Write c2 did not reach server 3")
+	}
+	clients[2].Write("c3", "1")
+
+	// whoever sees c3 must see its whole history
+	for i := 0; i < 3; i++ {
+		if v, _, _ := clients[i].Read("c3"); v == "1" {
+			c1, _, _ := clients[i].Read("c1")
+			c2, _, _ := clients[i].Read("c2")
+			if c1 != "1" || c2 != "1" {
+				t.Fatalf("Server %d shows c3 without c1 = %s, c2 = %s", i, c1, c2)
+			}
+		}
+	}
+}
+
+func TestCausalConcurrentWrites(t *testing.T) {
 	var clients [3]*services.Client
 	for i := 0; i < 3; i++ {
 		clients[i] = &services.Client{}
 		clients[i].Init(Cfg.ClientPorts[i], true)
 	}
 
-	clients[0].Write("a", "1")
+	// neither write sees the other
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			clients[i].Write("k", fmt.Sprintf("%d", i))
+		}(i)
+	}
+	wg.Wait()
+	time.Sleep(time.Millisecond * 200)
+
+	// every replica keeps the same winner and reports the conflict
+	var winner string
+	for i := 0; i < 3; i++ {
+		res, err := clients[i].ReadCausal("k")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Concurrent {
+			t.Fatalf("Server %d did not detect the concurrent writes", i)
+		}
+		if i > 0 && res.Value != winner {
+			t.Fatalf("Replicas diverged: %s and %s", winner, res.Value)
+		}
+		winner = res.Value
+	}
+}
+
+func TestCausalityConcurrency(t *testing.T) {
+	// testing with three clients
+	recorder := checker.NewRecorder()
+	var clients [3]*checker.Client
+	for i := 0; i < 3; i++ {
+		client := &services.Client{}
+		client.Init(Cfg.ClientPorts[i], true)
+		clients[i] = recorder.Client(i, client)
+	}
+	key := fmt.Sprintf("concurrency-%d", time.Now().UnixNano())
+
+	clients[0].Write(key, "1")
 	// multicast takes around 10ms time
 	// this should return stale y and x
-	clients[1].Write("a", "2")
+	clients[1].Write(key, "2")
 
-	clients[2].Read("a")
+	clients[2].Read(key)
 	time.Sleep(time.Millisecond * 50)
-	clients[2].Read("a")
+	clients[2].Read(key)
 	time.Sleep(time.Millisecond * 50)
-	clients[2].Read("a")
-	clients[0].Read("a")
+	clients[2].Read(key)
+	clients[0].Read(key)
+
+	if result := checker.CheckCausal(recorder.History()); !result.Ok {
+		t.Fatal(result)
+	}
 }
 
 func TestReadMinVersionSequence(t *testing.T) {
@@ -111,4 +191,126 @@ func TestCausalParallelConnections(t *testing.T) {
 	}
 
 	wg.Wait()
-}
\ No newline at end of file
+}
+
+func TestCausalDelete(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{}
+		clients[i].Init(Cfg.ClientPorts[i], true)
+	}
+
+	clients[0].Write("d", "1")
+	clients[0].Delete("d")
+	clients[0].Write("after-d", "1")
+
+	// whoever sees the write after the delete must see the delete too
+	time.Sleep(time.Millisecond * 100)
+	if v, _, _ := clients[1].Read("after-d"); v != "1" {
+		t.Fatalf("Write after-d did not reach server 2")
+	}
+	if v, _, _ := clients[1].Read("d"); v != "nil" {
+		t.Fatalf("Read d = %s after its delete", v)
+	}
+	if v, _, _ := clients[2].Read("d"); v != "nil" {
+		t.Fatalf("Read d = %s after its delete", v)
+	}
+}
+
+func TestCausalHistory(t *testing.T) {
+	recorder := checker.NewRecorder()
+	var clients [3]*checker.Client
+	for i := 0; i < 3; i++ {
+		client := &services.Client{}
+		client.Init(Cfg.ClientPorts[i], true)
+		clients[i] = recorder.Client(i, client)
+	}
+
+	// keys of this run only, so every key starts missing
+	prefix := fmt.Sprintf("history-%d/", time.Now().UnixNano())
+
+	// every client writes and reads three keys on its own server,
+	// reads carry what the client has seen to the next write
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 30; j++ {
+				key := prefix + fmt.Sprintf("%d", (i + j) % 3)
+				if j % 3 == 0 {
+					clients[i].Write(key, fmt.Sprintf("%d-%d", i, j))
+				} else if j % 9 == 4 {
+					clients[i].Delete(key)
+				} else {
+					clients[i].Read(key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if result := checker.CheckCausal(recorder.History()); !result.Ok {
+		t.Fatal(result)
+	}
+}
+
+func TestCausalReordering(t *testing.T) {
+	recorder := checker.NewRecorder()
+	var clients [3]*checker.Client
+	for i := 0; i < 3; i++ {
+		client := &services.Client{}
+		client.Init(Cfg.ClientPorts[i], true)
+		clients[i] = recorder.Client(i, client)
+	}
+	prefix := fmt.Sprintf("reorder-%d/", time.Now().UnixNano())
+
+	// writes overtake the ones they depend on, servers wait for the dependencies
+	services.ReorderMessages(100, 50 * time.Millisecond)
+	defer services.Heal()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 10; j++ {
+			clients[0].Write(prefix + fmt.Sprintf("%d", j), "1")
+		}
+	}()
+	for i := 1; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// later keys are read first, each one implies the earlier ones
+			for attempt := 0; attempt < 20; attempt++ {
+				for j := 9; j >= 0; j-- {
+					clients[i].Read(prefix + fmt.Sprintf("%d", j))
+				}
+				time.Sleep(time.Millisecond * 5)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if result := checker.CheckCausal(recorder.History()); !result.Ok {
+		t.Fatal(result)
+	}
+}
+
+func TestCausalRestart(t *testing.T) {
+	// the restarted server would have lost the writes it applied
+	KillServer(2)
+	err := services.StartCausalServer(Cfg.ClientPorts[2], Cfg.ServerPorts[2], Cfg.KvStorePorts[2])
+	if !errors.Is(err, services.ErrCausalRestart) {
+		t.Fatalf("Restart of a causal server returned %v", err)
+	}
+
+	// a new cluster starts every server afresh
+	StartServers(Causal)
+	time.Sleep(time.Millisecond * 500)
+	client := &services.Client{}
+	client.Init(Cfg.ClientPorts[2], true)
+	if _, err := client.Write("restart", "1"); err != nil {
+		t.Fatalf("Write to a new cluster failed: %v", err)
+	}
+}
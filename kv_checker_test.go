@@ -0,0 +1,153 @@
+package distkv
+
+import (
+	"math"
+	"testing"
+
+	"dist-kv/checker"
+)
+
+// an operation with times in milliseconds
+func op(client int, kind, key, value string, call, ret int64) checker.Operation {
+	if ret != math.MaxInt64 {
+		ret *= 1e6
+	}
+	return checker.Operation{Client: client, Kind: kind, Key: key, Value: value, Call: call * 1e6, Return: ret}
+}
+
+func TestCheckLinearizableOverlap(t *testing.T) {
+	// the read overlaps both writes, either value is fine
+	history := []checker.Operation{
+		op(0, checker.Write, "x", "1", 0, 10),
+		op(1, checker.Write, "x", "2", 5, 20),
+		op(2, checker.Read, "x", "1", 8, 30),
+		op(2, checker.Read, "x", "2", 31, 40),
+		op(0, checker.Read, "y", "", 0, 1),
+	}
+	if result := checker.CheckLinearizable(history); !result.Ok {
+		t.Fatal(result)
+	}
+}
+
+func TestCheckLinearizableStaleRead(t *testing.T) {
+	history := []checker.Operation{
+		op(0, checker.Write, "x", "1", 0, 10),
+		op(1, checker.Read, "x", "1", 12, 14),
+		op(0, checker.Write, "x", "2", 20, 30),
+		op(2, checker.Read, "x", "2", 32, 34),
+		op(2, checker.Write, "y", "1", 32, 34),
+		// reads 1 after 2 was read by a call that finished first
+		op(1, checker.Read, "x", "1", 40, 50),
+	}
+	result := checker.CheckLinearizable(history)
+	if result.Ok || result.Key != "x" {
+		t.Fatalf("Stale read passed: %v", result)
+	}
+	// two writes in a row and the late read show it, the other reads are not needed
+	if len(result.Counterexample) != 3 {
+		t.Fatalf("Counterexample is not minimal: %v", result)
+	}
+	t.Log(result)
+}
+
+func TestCheckLinearizableFailedWrite(t *testing.T) {
+	// a write that failed may still have taken effect, or not
+	history := []checker.Operation{
+		op(0, checker.Write, "x", "1", 0, math.MaxInt64),
+		op(1, checker.Read, "x", "", 5, 6),
+		op(1, checker.Read, "x", "1", 10, 11),
+	}
+	if result := checker.CheckLinearizable(history); !result.Ok {
+		t.Fatal(result)
+	}
+
+	// but it can not be undone once it was read
+	history = append(history, op(2, checker.Read, "x", "", 20, 21))
+	if result := checker.CheckLinearizable(history); result.Ok {
+		t.Fatalf("Read of an overwritten value passed")
+	}
+}
+
+func TestCheckSequentialStaleRead(t *testing.T) {
+	// a read may miss a write that finished in real time
+	history := []checker.Operation{
+		op(0, checker.Write, "x", "1", 0, 1),
+		op(1, checker.Read, "x", "", 10, 11),
+	}
+	if result := checker.CheckSequential(history); !result.Ok {
+		t.Fatal(result)
+	}
+	if result := checker.CheckLinearizable(history); result.Ok {
+		t.Fatalf("Stale read passed as linearizable")
+	}
+}
+
+func TestCheckSequentialOrder(t *testing.T) {
+	// concurrent writes, seen in a different order by two clients
+	history := []checker.Operation{
+		op(0, checker.Write, "x", "1", 0, 1),
+		op(1, checker.Write, "x", "2", 0, 1),
+		op(2, checker.Read, "x", "1", 2, 3),
+		op(2, checker.Read, "x", "2", 4, 5),
+		op(3, checker.Read, "x", "2", 2, 3),
+		op(3, checker.Read, "x", "1", 4, 5),
+	}
+	result := checker.CheckSequential(history)
+	if result.Ok {
+		t.Fatalf("Clients disagreeing on the order passed")
+	}
+	t.Log(result)
+
+	// causal consistency lets concurrent writes be seen in any order
+	if result := checker.CheckCausal(history); !result.Ok {
+		t.Fatal(result)
+	}
+}
+
+func TestCheckCausalWritesFollowReads(t *testing.T) {
+	// y = 1 was written after reading x = 1, so whoever sees y sees x
+	history := []checker.Operation{
+		op(0, checker.Write, "x", "1", 0, 1),
+		op(1, checker.Read, "x", "1", 2, 3),
+		op(1, checker.Write, "y", "1", 4, 5),
+		op(2, checker.Read, "y", "1", 6, 7),
+		op(2, checker.Read, "x", "", 8, 9),
+		op(2, checker.Read, "z", "", 8, 9),
+	}
+	result := checker.CheckCausal(history)
+	if result.Ok {
+		t.Fatalf("Missing dependency passed")
+	}
+	if len(result.Counterexample) != 5 {
+		t.Fatalf("Counterexample is not minimal: %v", result)
+	}
+	t.Log(result)
+
+	if result := checker.CheckSequential(history); result.Ok {
+		t.Fatalf("Missing dependency passed as sequential")
+	}
+}
+
+func TestCheckCausalMonotonicReads(t *testing.T) {
+	// the second write overwrites the first one for every reader that saw it
+	history := []checker.Operation{
+		op(0, checker.Write, "x", "1", 0, 1),
+		op(0, checker.Write, "x", "2", 2, 3),
+		op(1, checker.Read, "x", "2", 4, 5),
+		op(1, checker.Read, "x", "1", 6, 7),
+	}
+	if result := checker.CheckCausal(history); result.Ok {
+		t.Fatalf("Read going back in time passed")
+	}
+
+	// a delete is a write of the empty value
+	history = []checker.Operation{
+		op(0, checker.Write, "x", "1", 0, 1),
+		op(0, checker.Write, "x", "", 2, 3),
+		op(1, checker.Read, "x", "", 4, 5),
+		op(1, checker.Read, "x", "1", 6, 7),
+	}
+	if result := checker.CheckCausal(history); !result.Ok {
+		t.Fatal(result)
+	}
+}
@@ -0,0 +1,43 @@
+package distkv
+
+import (
+	"testing"
+
+	u "dist-kv/utils"
+)
+
+func TestHLCClockSkew(t *testing.T) {
+	// b runs 10 seconds behind a
+	a := u.NewHLCWithClock(func() int64 { return 20000 })
+	b := u.NewHLCWithClock(func() int64 { return 10000 })
+
+	sent := a.Now()
+	received := b.Update(sent)
+	if !sent.Less(received) {
+		t.Fatalf("Receive %v not after send %v", received, sent)
+	}
+
+	// later events on b stay ahead of what it has seen
+	next := b.Now()
+	if !received.Less(next) {
+		t.Fatalf("Clock went backwards from %v to %v", received, next)
+	}
+}
+
+func TestVectorClockOrder(t *testing.T) {
+	a := u.VectorClock{"1": 1}
+	b := u.VectorClock{"1": 1, "2": 1}
+	c := u.VectorClock{"3": 1}
+
+	if !b.Descends(a) || a.Descends(b) {
+		t.Fatalf("Expected %v to descend from %v", b, a)
+	}
+	if !b.Concurrent(c) {
+		t.Fatalf("Expected %v and %v to be concurrent", b, c)
+	}
+
+	b.Merge(c)
+	if !b.Descends(c) || b.Sum() != 3 {
+		t.Fatalf("Merge lost entries: %v", b)
+	}
+}
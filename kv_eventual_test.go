@@ -38,8 +38,8 @@ func TestEventual(t *testing.T) {
 		var v1, v2 string
 		for {
 			time.Sleep(time.Millisecond * 50)
-			v1, _ = clients[1].Read("x")
-			v2, _ = clients[2].Read("x")
+			v1, _, _ = clients[1].Read("x")
+			v2, _, _ = clients[2].Read("x")
 			if (v1 == "1") && (v2 == "1") { break }
 		}
 		log.Printf("Took %v to read x = %s from %s and %s\n", time.Since(start), v1, clients[1].ServerIface, clients[2].ServerIface)
@@ -77,4 +77,140 @@ func TestEventualParallelPerformance(t *testing.T) {
 	}
 
 	wg.Wait()
-}
\ No newline at end of file
+}
+
+func TestMultiplexedRequests(t *testing.T) {
+	// a single connection carries every request
+	client := &services.Client{ServerIface: Cfg.ClientPorts[0], PoolSize: 1}
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("m%d", i)
+			val := fmt.Sprintf("%d", i)
+			client.Write(key, val)
+			// local write, read your own write on the same server
+			if res, _, _ := client.Read(key); res != val {
+				t.Errorf("Response mismatch for %s: %s", key, res)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestEventualDelete(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+
+	// concurrent write and delete, every replica keeps the later one
+	clients[0].Write("d", "1")
+	clients[2].Delete("d")
+
+	var values [3]string
+	for attempt := 0; attempt < 100; attempt++ {
+		time.Sleep(time.Millisecond * 50)
+		for i := 0; i < 3; i++ {
+			values[i], _, _ = clients[i].Read("d")
+		}
+		if values[0] == values[1] && values[1] == values[2] {
+			break
+		}
+	}
+	if values[0] != values[1] || values[1] != values[2] {
+		t.Fatalf("Replicas did not converge after delete: %v", values)
+	}
+
+	// a delete after the write sticks once the tombstones are collected
+	clients[1].Write("d", "2")
+	time.Sleep(time.Millisecond * 200)
+	clients[1].Delete("d")
+	time.Sleep(time.Millisecond * 200)
+	for i := 0; i < 3; i++ {
+		if v, _, _ := clients[i].Read("d"); v != "nil" {
+			t.Fatalf("Read d = %s from %s after delete", v, clients[i].ServerIface)
+		}
+	}
+}
+
+func TestEventualTTL(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+
+	// replicas expire the key at the timestamp of its write plus the ttl
+	clients[0].WriteWithTTL("session", "1", 200 * time.Millisecond)
+	clients[0].WriteWithTTL("kept", "1", 200 * time.Millisecond)
+	clients[0].Persist("kept")
+
+	time.Sleep(300 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if v, _, _ := clients[i].Read("session"); v != "nil" {
+			t.Fatalf("Read session = %s from %s after it expired", v, clients[i].ServerIface)
+		}
+		if v, _, _ := clients[i].Read("kept"); v != "1" {
+			t.Fatalf("Read kept = %s from %s after persist", v, clients[i].ServerIface)
+		}
+	}
+}
+
+func TestEventualPartition(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+	key := fmt.Sprintf("partition-%d", time.Now().UnixNano())
+
+	// both sides keep accepting writes
+	services.Partition(Cfg.ServerPorts[:2], Cfg.ServerPorts[2:])
+	defer services.Heal()
+	if _, err := clients[0].Write(key, "1"); err != nil {
+		t.Fatalf("Write failed during the partition: %v", err)
+	}
+	if _, err := clients[2].Write(key, "2"); err != nil {
+		t.Fatalf("Write failed during the partition: %v", err)
+	}
+
+	time.Sleep(time.Millisecond * 200)
+	if v, _, _ := clients[1].Read(key); v != "1" {
+		t.Fatalf("Read %s = %s on the side of the first write", key, v)
+	}
+	if v, _, _ := clients[2].Read(key); v != "2" {
+		t.Fatalf("Read %s = %s on the side of the second write", key, v)
+	}
+
+	// every replica keeps the later write once the partition heals
+	services.Heal()
+	time.Sleep(time.Millisecond * 200)
+	for i := 0; i < 3; i++ {
+		if v, _, _ := clients[i].Read(key); v != "2" {
+			t.Fatalf("Read %s = %s from %s after the partition healed", key, v, clients[i].ServerIface)
+		}
+	}
+}
+
+func TestEventualDuplicates(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+	key := fmt.Sprintf("duplicates-%d", time.Now().UnixNano())
+
+	// applying a write twice changes nothing, the later write still wins
+	services.DuplicateMessages(100)
+	defer services.Heal()
+	clients[0].Write(key, "1")
+	clients[1].Write(key, "2")
+
+	time.Sleep(time.Millisecond * 200)
+	for i := 0; i < 3; i++ {
+		if v, _, _ := clients[i].Read(key); v != "2" {
+			t.Fatalf("Read %s = %s from %s with duplicated messages", key, v, clients[i].ServerIface)
+		}
+	}
+}
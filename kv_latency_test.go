@@ -0,0 +1,79 @@
+package distkv
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	u "dist-kv/utils"
+)
+
+func TestLatencyNone(t *testing.T) {
+	// no model means no artificial delay
+	var model u.LatencyModel
+	if d := model.Delay("49090", "49092", rand.New(rand.NewSource(1))); d != 0 {
+		t.Fatalf("Delay without a model = %v, want 0", d)
+	}
+}
+
+func TestLatencyLinks(t *testing.T) {
+	model := u.LatencyModel{
+		MeanMs: 1,
+		Regions: map[string][]string{
+			"east": {"1", "2"},
+			"west": {"3", "4"},
+		},
+		Links: []u.LinkLatency{
+			{From: "east", To: "west", MeanMs: 30},
+			{From: "west", To: "east", MeanMs: 40},
+			{From: "east", To: "east", MeanMs: 2},
+			{From: "2", To: "west", MeanMs: 50},
+			{From: "4", To: "1", MeanMs: 70},
+		},
+	}
+	r := rand.New(rand.NewSource(1))
+
+	for _, c := range []struct {
+		from, to string
+		want     time.Duration
+	}{
+		{"1", "3", 30 * time.Millisecond}, // region to region
+		{"3", "1", 40 * time.Millisecond}, // the other direction is listed
+		{"1", "1", 2 * time.Millisecond},  // within a region, itself included
+		{"2", "3", 50 * time.Millisecond}, // port to region beats region to region
+		{"3", "2", 50 * time.Millisecond}, // and applies both ways
+		{"1", "4", 70 * time.Millisecond}, // port to port beats everything
+		{"3", "4", time.Millisecond},      // not listed
+		{"1", "9", time.Millisecond},      // in no region
+	} {
+		if d := model.Delay(c.from, c.to, r); d != c.want {
+			t.Fatalf("Delay %s to %s = %v, want %v", c.from, c.to, d, c.want)
+		}
+	}
+}
+
+func TestLatencyDistributions(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	uniform := u.LatencyModel{MeanMs: 10, JitterMs: 2, Distribution: u.UniformLatency}
+	normal := u.LatencyModel{MeanMs: 10, JitterMs: 2, Distribution: u.NormalLatency}
+	var sum time.Duration
+	const draws = 10000
+	for i := 0; i < draws; i++ {
+		if d := uniform.Delay("1", "2", r); d < 8*time.Millisecond || d > 12*time.Millisecond {
+			t.Fatalf("uniform delay %v outside of 10ms +- 2ms", d)
+		}
+		sum += normal.Delay("1", "2", r)
+	}
+	if mean := sum / draws; mean < 9*time.Millisecond || mean > 11*time.Millisecond {
+		t.Fatalf("mean of normal delays = %v, want about 10ms", mean)
+	}
+
+	// a delay never goes below zero
+	wide := u.LatencyModel{MeanMs: 1, JitterMs: 50, Distribution: u.NormalLatency}
+	for i := 0; i < draws; i++ {
+		if d := wide.Delay("1", "2", r); d < 0 {
+			t.Fatalf("negative delay %v", d)
+		}
+	}
+}
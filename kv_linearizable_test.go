@@ -1,12 +1,18 @@
 package distkv
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"dist-kv/checker"
+	"dist-kv/protocol"
 	"dist-kv/services"
 )
 
@@ -36,7 +42,7 @@ func TestLinearizbility(t *testing.T) {
 	go func() {
 		time.Sleep(time.Millisecond * 50)
 		defer wg.Done()
-		v, _ := clients[1].Read("x")
+		v, _, _ := clients[1].Read("x")
 		if v != "3" {
 			log.Fatal("Test falied")
 		}
@@ -49,7 +55,7 @@ func TestLinearizbility(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		v, _ := clients[2].Read("x")
+		v, _, _ := clients[2].Read("x")
 		if v != "3" {
 			log.Fatal("Test falied")
 		}
@@ -92,7 +98,7 @@ func TestLinearizbilityPerformance(t *testing.T) {
 		val := fmt.Sprintf("%d", i)
 		client.Write(key, val)
 		client = clients[(i + 1) % 3]
-		res, _ := client.Read(key)
+		res, _, _ := client.Read(key)
 		if res != val {
 			t.Fatalf("Cannot read last write!")
 		}
@@ -126,4 +132,461 @@ func TestParallelRequests(t *testing.T) {
 	}
 
 	wg.Wait()
-}
\ No newline at end of file
+}
+
+func TestLargeValue(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+
+	// values larger than a single TCP read must survive the round trip
+	val := strings.Repeat("v", 256 * 1024)
+	clients[0].Write("large", val)
+	res, _, _ := clients[1].Read("large")
+	if res != val {
+		t.Fatalf("Large value was truncated to %d bytes", len(res))
+	}
+}
+
+func TestLinearizableDelete(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+
+	clients[0].Write("d", "1")
+	clients[1].Delete("d")
+
+	// the delete is ordered after the write on every server
+	for i := 0; i < 3; i++ {
+		if v, _, _ := clients[i].Read("d"); v != "" {
+			t.Fatalf("Read d = %s from %s after delete", v, clients[i].ServerIface)
+		}
+	}
+}
+
+func TestCompareAndSetCounter(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+
+	// the first cas on a missing key acts as a lock
+	if ok, _, _ := clients[0].CompareAndSet("counter", "", "0"); !ok {
+		t.Fatalf("Compare and set on a missing key failed")
+	}
+	if ok, _, _ := clients[1].CompareAndSet("counter", "", "0"); ok {
+		t.Fatalf("Compare and set succeeded on a stale value")
+	}
+
+	// concurrent increments, every one retries until its cas wins
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(c *services.Client) {
+			defer wg.Done()
+			for n := 0; n < 5; n++ {
+				current, _, _ := c.Read("counter")
+				for {
+					next, _ := strconv.Atoi(current)
+					ok, now, _ := c.CompareAndSet("counter", current, strconv.Itoa(next + 1))
+					if ok { break }
+					current = now
+				}
+			}
+		}(clients[i])
+	}
+	wg.Wait()
+
+	if v, _, _ := clients[2].Read("counter"); v != "15" {
+		t.Fatalf("Counter is %s after 15 increments", v)
+	}
+
+	// versions work the same way
+	_, version, _ := clients[0].Read("counter")
+	if ok, _, _ := clients[0].CompareVersionAndSet("counter", version, "0"); !ok {
+		t.Fatalf("Compare and set at version %s failed", version)
+	}
+	if ok, _, _ := clients[1].CompareVersionAndSet("counter", version, "1"); ok {
+		t.Fatalf("Compare and set succeeded on a stale version")
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+
+	clients[0].Write("alice", "100")
+	clients[0].Write("bob", "0")
+
+	// a transfer moves money between two keys atomically
+	tx, err := clients[0].Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	tx.Set("alice", "60")
+	tx.Set("bob", "40")
+
+	// a concurrent transaction reads the snapshot from before the transfer
+	other, err := clients[1].Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	a, _ := other.Get("alice")
+	b, _ := other.Get("bob")
+	if a != "100" || b != "0" {
+		t.Fatalf("Snapshot read alice = %s, bob = %s", a, b)
+	}
+
+	// it wrote a key committed after its snapshot, first committer wins
+	other.Set("bob", "1")
+	if err := other.Commit(); err != services.ErrTxConflict {
+		t.Fatalf("Conflicting commit returned %v", err)
+	}
+
+	// every server sees the whole transfer
+	for i := 0; i < 3; i++ {
+		a, _, _ := clients[i].Read("alice")
+		b, _, _ := clients[i].Read("bob")
+		if a != "60" || b != "40" {
+			t.Fatalf("Read alice = %s, bob = %s from %s", a, b, clients[i].ServerIface)
+		}
+	}
+
+	// aborted writes are never applied
+	tx, _ = clients[2].Begin()
+	tx.Delete("alice")
+	tx.Abort()
+	if a, _, _ := clients[2].Read("alice"); a != "60" {
+		t.Fatalf("Read alice = %s after an aborted delete", a)
+	}
+}
+
+func TestScan(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+
+	for i := 0; i < 5; i++ {
+		clients[i % 3].Write(fmt.Sprintf("scan/%d", i), fmt.Sprintf("%d", i))
+	}
+	clients[0].Write("scan0", "outside the prefix")
+
+	// pages of two follow the cursor until the last one
+	var keys []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		entries, next, err := clients[1].ScanPrefix("scan/", 2, cursor)
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+		if next == "" { break }
+		if pages > 5 {
+			t.Fatalf("Scan did not finish, cursor %s", next)
+		}
+		cursor = next
+	}
+	if strings.Join(keys, ",") != "scan/0,scan/1,scan/2,scan/3,scan/4" {
+		t.Fatalf("Scanned keys %v", keys)
+	}
+
+	// the end of a range is exclusive
+	entries, _, _ := clients[2].Scan("scan/1", "scan/3", 0, "")
+	if len(entries) != 2 || entries[0].Value != "1" || entries[1].Key != "scan/2" {
+		t.Fatalf("Scanned %v", entries)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+
+	clients[0].WriteWithTTL("session", "1", 300 * time.Millisecond)
+	clients[0].WriteWithTTL("kept", "1", 300 * time.Millisecond)
+
+	ttl, ok, err := clients[1].TTL("session")
+	if err != nil {
+		t.Fatalf("Ttl of session failed: %v", err)
+	}
+	if !ok || ttl <= 0 || ttl > 300 * time.Millisecond {
+		t.Fatalf("Ttl of session is %v, exists %v", ttl, ok)
+	}
+	if ok, _ := clients[2].Persist("kept"); !ok {
+		t.Fatalf("Persist of kept removed no expiry")
+	}
+	if ttl, ok, _ := clients[2].TTL("kept"); !ok || ttl != -1 {
+		t.Fatalf("Ttl of kept is %v after persist", ttl)
+	}
+
+	// every server drops the key once the order passes its expiry
+	time.Sleep(400 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if v, _, _ := clients[i].Read("session"); v != "" {
+			t.Fatalf("Read session = %s from %s after it expired", v, clients[i].ServerIface)
+		}
+		if v, _, _ := clients[i].Read("kept"); v != "1" {
+			t.Fatalf("Read kept = %s from %s after persist", v, clients[i].ServerIface)
+		}
+	}
+	if _, ok, _ := clients[0].TTL("session"); ok {
+		t.Fatalf("Ttl reported for an expired key")
+	}
+}
+
+func TestMultiSetGet(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+
+	// one ack round for the whole batch
+	values := map[string]string{}
+	keys := []string{"batch-missing"}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("batch-%d", i)
+		values[key] = fmt.Sprintf("%d", i)
+		keys = append(keys, key)
+	}
+	if err := clients[0].MultiSet(values); err != nil {
+		t.Fatalf("Write of %d keys failed: %v", len(values), err)
+	}
+
+	got, err := clients[1].MultiGet(keys)
+	if err != nil {
+		t.Fatalf("Read of %d keys failed: %v", len(keys), err)
+	}
+	if len(got) != len(values) {
+		t.Fatalf("Read %d of %d keys", len(got), len(values))
+	}
+	for k, v := range values {
+		if got[k] != v {
+			t.Fatalf("Read %s = %s, expected %s", k, got[k], v)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	writer := &services.Client{ServerIface: Cfg.ClientPorts[0], TrackVersion: false}
+	watcher := &services.Client{ServerIface: Cfg.ClientPorts[1], TrackVersion: false}
+
+	next := func(w *services.Watch) services.WatchEvent {
+		select {
+		case event, ok := <-w.Events:
+			if !ok {
+				t.Fatalf("Watch ended: %v", w.Err())
+			}
+			return event
+		case <-time.After(2 * time.Second):
+			t.Fatalf("No watch event")
+		}
+		return services.WatchEvent{}
+	}
+
+	// writes applied on the replica of the watcher are streamed in order
+	w, err := watcher.WatchPrefix("watch/", 0)
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	writer.Write("watch/a", "1")
+	writer.Write("other", "1")
+	writer.Delete("watch/a")
+
+	set := next(w)
+	if set.Op != "set" || set.Key != "watch/a" || set.Value != "1" {
+		t.Fatalf("Expected set watch/a = 1, got %+v", set)
+	}
+	del := next(w)
+	if del.Op != "del" || del.Key != "watch/a" || del.Version != set.Version {
+		t.Fatalf("Expected del watch/a at version %d, got %+v", set.Version, del)
+	}
+	w.Close()
+	for range w.Events {
+	}
+
+	// a watch resumed after the last revision misses nothing
+	writer.Write("watch/b", "2")
+	writer.Write("watch/c", "3")
+	w, err = watcher.WatchPrefix("watch/", del.Revision)
+	if err != nil {
+		t.Fatalf("Resuming watch failed: %v", err)
+	}
+	defer w.Close()
+	for _, key := range []string{"watch/b", "watch/c"} {
+		if event := next(w); event.Key != key {
+			t.Fatalf("Expected event on %s after resume, got %+v", key, event)
+		}
+	}
+
+	// a single key watch ignores its neighbours
+	k, err := watcher.Watch("watch/b", 0)
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer k.Close()
+	writer.Write("watch/c", "4")
+	writer.Write("watch/b", "5")
+	if event := next(k); event.Key != "watch/b" || event.Value != "5" {
+		t.Fatalf("Expected set watch/b = 5, got %+v", event)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+
+	clients[0].Write("cdc/a", "1")
+	clients[1].MultiSet(map[string]string{"cdc/b": "2", "cdc/c": "3"})
+	clients[2].Delete("cdc/a")
+	time.Sleep(100 * time.Millisecond)
+
+	// every replica applies the writes in the same total order
+	// so their change logs are identical, read page by page
+	var logs [3][]services.WatchEvent
+	for i := 0; i < 3; i++ {
+		offset := int64(1)
+		for {
+			changes, next, err := clients[i].Changes(offset, 50)
+			if err != nil {
+				t.Fatalf("Changes from %s failed: %v", clients[i].ServerIface, err)
+			}
+			if len(changes) == 0 {
+				break
+			}
+			if changes[0].Revision != offset || next != offset + int64(len(changes)) {
+				t.Fatalf("Changes from offset %d returned %d..%d", offset, changes[0].Revision, next)
+			}
+			logs[i] = append(logs[i], changes...)
+			offset = next
+		}
+	}
+	for i := 1; i < 3; i++ {
+		if fmt.Sprint(logs[i]) != fmt.Sprint(logs[0]) {
+			t.Fatalf("Change log of %s differs from %s", clients[i].ServerIface, clients[0].ServerIface)
+		}
+	}
+
+	tail := logs[0][len(logs[0]) - 4:]
+	expected := []string{"set cdc/a 1", "set cdc/b 2", "set cdc/c 3", "del cdc/a "}
+	for i, change := range tail {
+		if got := change.Op + " " + change.Key + " " + change.Value; got != expected[i] {
+			t.Fatalf("Change %d is %q, expected %q", change.Revision, got, expected[i])
+		}
+	}
+
+	// exported as JSON lines, one change per line
+	var export bytes.Buffer
+	if err := services.ExportChanges(&export, tail); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(export.String(), "\n"), "\n")
+	last := fmt.Sprintf(`{"revision":%d,"op":"del","key":"cdc/a","version":%d}`, tail[3].Revision, tail[3].Version)
+	if len(lines) != 4 || lines[3] != last {
+		t.Fatalf("Exported changes %q", export.String())
+	}
+}
+
+func TestLinearizableHistory(t *testing.T) {
+	recorder := checker.NewRecorder()
+	var clients [3]*checker.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = recorder.Client(i, &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false})
+	}
+
+	// keys of this run only, so every register starts empty
+	prefix := fmt.Sprintf("history-%d/", time.Now().UnixNano())
+
+	// concurrent writes and reads of two registers on every server
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				key := prefix + strconv.Itoa(j % 2)
+				if (i + j) % 3 == 0 {
+					clients[i].Write(key, fmt.Sprintf("%d-%d", i, j))
+				} else {
+					clients[i].Read(key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if result := checker.CheckLinearizable(recorder.History()); !result.Ok {
+		t.Fatal(result)
+	}
+}
+
+func TestLinearizablePartition(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+	key := fmt.Sprintf("partition-%d", time.Now().UnixNano())
+
+	// server 3 is cut off, a write waits for the ack of every server
+	services.Partition(Cfg.ServerPorts[:2], Cfg.ServerPorts[2:])
+	defer services.Heal()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := clients[0].Write(key, "1")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Write completed across a partition: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// the messages held by the partition go through once it heals
+	services.Heal()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Write failed after the partition healed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Write did not complete after the partition healed")
+	}
+	if v, _, _ := clients[2].Read(key); v != "1" {
+		t.Fatalf("Read %s = %s from the healed server", key, v)
+	}
+}
+
+func TestLinearizableTimeout(t *testing.T) {
+	key := fmt.Sprintf("timeout-%d", time.Now().UnixMilli())
+	services.Partition(Cfg.ServerPorts[:2], Cfg.ServerPorts[2:])
+	defer services.Heal()
+
+	// the client gives up on its own deadline
+	impatient := &services.Client{ServerIface: Cfg.ClientPorts[0], Timeout: 200 * time.Millisecond}
+	start := time.Now()
+	if _, err := impatient.Write(key, "1"); !errors.Is(err, protocol.Timeout) {
+		t.Fatalf("Write across a partition returned %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Client waited %v past its deadline", elapsed)
+	}
+
+	// the server gives up once the cut off replica has not acked in time
+	client := &services.Client{ServerIface: Cfg.ClientPorts[1]}
+	if _, err := client.Write(key, "2"); !errors.Is(err, protocol.Timeout) {
+		t.Fatalf("Write across a partition returned %v, want a timeout", err)
+	}
+}
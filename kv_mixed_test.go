@@ -0,0 +1,142 @@
+package distkv
+
+import (
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"dist-kv/protocol"
+	"dist-kv/services"
+)
+
+// tests may not execute in the sequential order
+// so we may have to check if servers are started in every test
+
+func TestStartMixedServer(t *testing.T) {
+	StartServers(Mixed)
+
+	log.Printf("Waiting for 3 servers to bootup...\n\n")
+	time.Sleep(time.Millisecond * 500)
+}
+
+func TestMixedLinearizable(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], Consistency: services.LinearizableLevel}
+	}
+
+	clients[0].Write("x", "1")
+	if res, _, _ := clients[1].Read("x"); res != "1" {
+		t.Fatalf("Linearizable read returned %s", res)
+	}
+}
+
+func TestMixedPerRequestLevels(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{}
+		clients[i].Init(Cfg.ClientPorts[i], true)
+	}
+
+	// a local eventual write is visible on its own server right away
+	clients[0].WriteWithConsistency("y", "1", services.EventualLevel)
+	if res, _, _ := clients[0].ReadWithConsistency("y", services.EventualLevel); res != "1" {
+		t.Fatalf("Eventual read of own write returned %s", res)
+	}
+
+	// sequential writes go through the total order on every replica
+	clients[1].WriteWithConsistency("z", "1", services.SequentialLevel)
+	if res, _, _ := clients[1].ReadWithConsistency("z", services.SequentialLevel); res != "1" {
+		t.Fatalf("Sequential read of own write returned %s", res)
+	}
+
+	// causal writes share the replicas with the other levels
+	clients[2].WriteWithConsistency("w", "1", services.CausalLevel)
+	if res, _, _ := clients[2].ReadWithConsistency("w", services.CausalLevel); res != "1" {
+		t.Fatalf("Causal read of own write returned %s", res)
+	}
+	if res, _, _ := clients[2].ReadWithConsistency("w", services.LinearizableLevel); res != "1" {
+		t.Fatalf("Linearizable read of causal write returned %s", res)
+	}
+}
+
+func TestMixedLevelsOnOneKey(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{}
+		clients[i].Init(Cfg.ClientPorts[i], true)
+	}
+
+	// the latest write wins at every level and on every replica
+	expect := func(value string) {
+		time.Sleep(time.Millisecond * 300)
+		for i := 0; i < 3; i++ {
+			for _, level := range []string{services.LinearizableLevel, services.SequentialLevel, services.EventualLevel, services.CausalLevel} {
+				if res, _, _ := clients[i].ReadWithConsistency("k", level); res != value {
+					t.Fatalf("%s read on server %d returned %s, expected %s", level, i, res, value)
+				}
+			}
+		}
+	}
+
+	clients[0].WriteWithConsistency("k", "lin", services.LinearizableLevel)
+	expect("lin")
+	clients[1].WriteWithConsistency("k", "ev", services.EventualLevel)
+	expect("ev")
+	clients[2].WriteWithConsistency("k", "cau", services.CausalLevel)
+	expect("cau")
+	clients[0].WriteWithConsistency("k", "seq", services.SequentialLevel)
+	expect("seq")
+
+	// an eventual delete removes the key for the linearizable level too
+	clients[1].DeleteWithConsistency("k", services.EventualLevel)
+	time.Sleep(time.Millisecond * 300)
+	for i := 0; i < 3; i++ {
+		if res, _, _ := clients[i].ReadWithConsistency("k", services.LinearizableLevel); res != "" {
+			t.Fatalf("Linearizable read on server %d of a deleted key returned %s", i, res)
+		}
+	}
+}
+
+func TestMixedTxnSeesOtherLevels(t *testing.T) {
+	client := &services.Client{ServerIface: Cfg.ClientPorts[0]}
+	client.WriteWithConsistency("tk", "ev", services.EventualLevel)
+
+	tx, err := client.Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	if res, err := tx.Get("tk"); err != nil || res != "ev" {
+		t.Fatalf("Transaction read of eventual write returned %s, %v", res, err)
+	}
+	tx.Abort()
+}
+
+func TestMixedUnknownLevel(t *testing.T) {
+	client := &services.Client{ServerIface: Cfg.ClientPorts[0], Consistency: "strong"}
+	if res, _, err := client.Read("x"); !errors.Is(err, protocol.BadRequest) {
+		t.Fatalf("Unknown consistency level was served: %s, %v", res, err)
+	}
+}
+
+func TestMixedCompareAndSet(t *testing.T) {
+	client := &services.Client{ServerIface: Cfg.ClientPorts[0], Consistency: services.LinearizableLevel}
+	if ok, _, _ := client.CompareAndSet("cas", "", "1"); !ok {
+		t.Fatalf("Linearizable compare and set failed")
+	}
+
+	// only the linearizable level has a single order to decide it in
+	client.Consistency = services.EventualLevel
+	if ok, _, err := client.CompareAndSet("cas", "1", "2"); ok || !errors.Is(err, protocol.Unsupported) {
+		t.Fatalf("Eventual compare and set was not rejected: %v", err)
+	}
+}
+
+func TestMixedUnavailable(t *testing.T) {
+	// nothing listens on the port, the request fails instead of the process
+	client := &services.Client{ServerIface: "1"}
+	if _, err := client.Write("x", "1"); !errors.Is(err, protocol.Unavailable) {
+		t.Fatalf("Write to a missing server returned %v", err)
+	}
+}
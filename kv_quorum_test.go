@@ -0,0 +1,109 @@
+package distkv
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"testing"
+	"time"
+
+	"dist-kv/protocol"
+	"dist-kv/services"
+)
+
+// tests may not execute in the sequential order
+// so we may have to check if servers are started in every test
+
+func TestStartQuorumServer(t *testing.T) {
+	StartServers(Quorum)
+
+	log.Printf("Waiting for 3 servers to bootup...\n\n")
+	time.Sleep(time.Millisecond * 500)
+}
+
+func TestQuorumReadAfterWrite(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+
+	// R + W > N, a read always overlaps the last write
+	for i := 0; i < 10; i++ {
+		val := fmt.Sprintf("%d", i)
+		clients[i % 3].Write("x", val)
+		res, _, _ := clients[(i + 1) % 3].Read("x")
+		if res != val {
+			t.Fatalf("Expected x = %s, got %s", val, res)
+		}
+	}
+}
+
+func TestQuorumNewestVersionWins(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+
+	clients[0].Write("y", "1")
+	clients[1].Write("y", "2")
+
+	res, version, _ := clients[2].Read("y")
+	if res != "2" || version == "" {
+		t.Fatalf("Expected newest y = 2 with a version, got %s at %s", res, version)
+	}
+}
+
+func TestQuorumDuplicates(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i]}
+	}
+
+	// every reply arrives twice, the extra ones must not stall the peer links
+	services.DuplicateMessages(100)
+	defer services.Heal()
+	for i := 0; i < 20; i++ {
+		val := fmt.Sprintf("%d", i)
+		if _, err := clients[i % 3].Write("dup", val); err != nil {
+			t.Fatalf("Write with duplicated messages: %v", err)
+		}
+		if res, _, err := clients[(i + 1) % 3].Read("dup"); err != nil || res != val {
+			t.Fatalf("Expected dup = %s, got %s: %v", val, res, err)
+		}
+	}
+}
+
+func TestQuorumDelete(t *testing.T) {
+	client := &services.Client{ServerIface: Cfg.ClientPorts[0]}
+	if err := client.Delete("x"); !errors.Is(err, protocol.Unsupported) {
+		t.Fatalf("Delete returned %v, want unsupported", err)
+	}
+}
+
+func TestQuorumReplicaDown(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+
+	// W = R = 2 out of N = 3 tolerates one replica down
+	KillServer(0)
+
+	clients[1].Write("z", "1")
+	res, _, _ := clients[2].Read("z")
+	if res != "1" {
+		t.Fatalf("Expected z = 1 with a replica down, got %s", res)
+	}
+}
+
+func TestQuorumMajorityDown(t *testing.T) {
+	client := &services.Client{ServerIface: Cfg.ClientPorts[2]}
+
+	// with two of three replicas down the write can not reach W = 2
+	KillServer(0)
+	KillServer(1)
+
+	if _, err := client.Write("z", "2"); !errors.Is(err, protocol.Unavailable) {
+		t.Fatalf("Write with a majority down returned %v, want unavailable", err)
+	}
+}
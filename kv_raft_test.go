@@ -0,0 +1,232 @@
+package distkv
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"dist-kv/checker"
+	"dist-kv/services"
+)
+
+// tests may not execute in the sequential order
+// so we may have to check if servers are started in every test
+
+func TestStartRaftServer(t *testing.T) {
+	StartServers(Raft)
+
+	// leader election takes a few hundred milliseconds
+	log.Printf("Waiting for 3 servers to bootup...\n\n")
+	time.Sleep(time.Millisecond * 1500)
+}
+
+func TestRaftReadAfterWrite(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+
+	// every server serves the latest write, wherever it was issued
+	for i := 0; i < 10; i++ {
+		val := fmt.Sprintf("%d", i)
+		clients[i % 3].Write("x", val)
+		res, _, _ := clients[(i + 1) % 3].Read("x")
+		if res != val {
+			t.Fatalf("Expected x = %s, got %s", val, res)
+		}
+	}
+}
+
+func TestRaftParallelRequests(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("p%d", i)
+			val := fmt.Sprintf("%d", i)
+			clients[i % 3].Write(key, val)
+			if res, _, _ := clients[(i + 1) % 3].Read(key); res != val {
+				t.Errorf("Expected %s = %s, got %s", key, val, res)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestRaftMinorityDown(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+	clients[0].Write("y", "1")
+
+	// one of three servers down, the majority keeps serving
+	KillServer(0)
+
+	clients[1].Write("y", "2")
+	res, _, _ := clients[2].Read("y")
+	if res != "2" {
+		t.Fatalf("Expected y = 2 with a minority down, got %s", res)
+	}
+}
+
+func TestRaftScan(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 1; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+
+	clients[1].Write("scan/a", "1")
+	clients[2].Write("scan/b", "2")
+
+	// scans are ordered in the log wherever they are issued
+	for i := 1; i < 3; i++ {
+		entries, cursor, err := clients[i].ScanPrefix("scan/", 1, "")
+		if err != nil || len(entries) != 1 || entries[0].Key != "scan/a" || cursor != "scan/a" {
+			t.Fatalf("First page %v cursor %s: %v", entries, cursor, err)
+		}
+		entries, cursor, err = clients[i].ScanPrefix("scan/", 1, cursor)
+		if err != nil || len(entries) != 1 || entries[0].Value != "2" || cursor != "" {
+			t.Fatalf("Last page %v cursor %s: %v", entries, cursor, err)
+		}
+	}
+}
+
+func TestRaftDuplicatesAndReordering(t *testing.T) {
+	recorder := checker.NewRecorder()
+	var clients [3]*checker.Client
+	for i := 1; i < 3; i++ {
+		clients[i] = recorder.Client(i, &services.Client{ServerIface: Cfg.ClientPorts[i]})
+	}
+
+	// stale AppendEntries arrive after newer ones and twice
+	services.DuplicateMessages(30)
+	services.ReorderMessages(30, 30*time.Millisecond)
+	defer services.Heal()
+
+	var wg sync.WaitGroup
+	for i := 1; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				clients[i].Write("dup", fmt.Sprintf("%d-%d", i, j))
+				clients[i].Read("dup")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if result := checker.CheckLinearizable(recorder.History()); !result.Ok {
+		t.Fatal(result)
+	}
+}
+
+func TestRaftRestart(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i]}
+	}
+	if _, err := clients[1].Write("restart", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// every server goes down, the data lives on in the saved logs
+	KillServer(1)
+	KillServer(2)
+	for i := 0; i < 3; i++ {
+		RestartServer(i)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		res, _, err := clients[i].Read("restart")
+		if err != nil || res != "1" {
+			t.Fatalf("Read restart = %s after a full restart: %v", res, err)
+		}
+	}
+}
+
+func TestRaftTTL(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i]}
+	}
+
+	clients[0].WriteWithTTL("session", "1", 300 * time.Millisecond)
+	clients[0].WriteWithTTL("kept", "1", 300 * time.Millisecond)
+	if ttl, ok, err := clients[1].TTL("session"); err != nil || !ok || ttl <= 0 {
+		t.Fatalf("TTL of session = %v, %t: %v", ttl, ok, err)
+	}
+	if persisted, err := clients[2].Persist("kept"); err != nil || !persisted {
+		t.Fatalf("Persist kept = %t: %v", persisted, err)
+	}
+
+	// every server expires the key at the same entry of the log
+	time.Sleep(400 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if v, _, _ := clients[i].Read("session"); v == "1" {
+			t.Fatalf("Read session = %s from %s after it expired", v, clients[i].ServerIface)
+		}
+		if v, _, _ := clients[i].Read("kept"); v != "1" {
+			t.Fatalf("Read kept = %s from %s after it was persisted", v, clients[i].ServerIface)
+		}
+	}
+}
+
+// collects the leaders every server announces in its log, by term
+type leaderLog struct {
+	mu      sync.Mutex
+	leaders map[string]map[string]bool
+}
+
+var leaderLine = regexp.MustCompile(`Server (\d+) is the leader for term (\d+)`)
+
+func (l *leaderLog) Write(line []byte) (int, error) {
+	if m := leaderLine.FindSubmatch(line); m != nil {
+		l.mu.Lock()
+		term := string(m[2])
+		if l.leaders[term] == nil {
+			l.leaders[term] = map[string]bool{}
+		}
+		l.leaders[term][string(m[1])] = true
+		l.mu.Unlock()
+	}
+	return len(line), nil
+}
+
+func TestRaftDuplicateVotes(t *testing.T) {
+	leaders := &leaderLog{leaders: map[string]map[string]bool{}}
+	log.SetOutput(io.MultiWriter(os.Stderr, leaders))
+	defer log.SetOutput(os.Stderr)
+
+	// both sides of the partition elect a leader for the first term,
+	// every vote arrives twice, a grant counted twice makes a minority win
+	StartCluster(Raft, 5)
+	services.Partition(Cfg.ServerPorts[:2], Cfg.ServerPorts[2:5])
+	services.DuplicateMessages(100)
+	defer services.Heal()
+	time.Sleep(2 * time.Second)
+
+	leaders.mu.Lock()
+	defer leaders.mu.Unlock()
+	if len(leaders.leaders) == 0 {
+		t.Fatalf("No leader was elected")
+	}
+	for term, servers := range leaders.leaders {
+		if len(servers) > 1 {
+			t.Fatalf("Term %s has leaders %v", term, servers)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"dist-kv/checker"
 	"dist-kv/services"
 )
 
@@ -46,7 +47,7 @@ func TestSequential1(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		v, _ := clients[2].Read("x")
+		v, _, _ := clients[2].Read("x")
 		if v != "1" {
 			log.Fatal("Test falied")
 		}
@@ -56,24 +57,34 @@ func TestSequential1(t *testing.T) {
 }
 
 func TestSequentialOrder(t *testing.T) {
-	var clients [3]*services.Client
+	recorder := checker.NewRecorder()
+	var clients [3]*checker.Client
 	for i := 0; i < 3; i++ {
-		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+		clients[i] = recorder.Client(i, &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false})
 	}
+	key := fmt.Sprintf("order-%d", time.Now().UnixNano())
 
-	go func() {
-		clients[0].Write("a", "1")
-	}()
-	
-	go func() {
-		clients[1].Write("a", "2")
-	}()
+	// every server applies the concurrent writes in the same order
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			clients[i].Write(key, fmt.Sprintf("%d", i + 1))
+			clients[i].Read(key)
+		}(i)
+	}
+	clients[2].Read(key)
+	wg.Wait()
 
 	time.Sleep(time.Millisecond * 50)
 
-	clients[1].Read("a")
-	clients[2].Read("a")
-	
+	for i := 0; i < 3; i++ {
+		clients[i].Read(key)
+	}
+	if result := checker.CheckSequential(recorder.History()); !result.Ok {
+		t.Fatal(result)
+	}
 }
 
 func TestSequentialPerformance(t *testing.T) {
@@ -90,7 +101,7 @@ func TestSequentialPerformance(t *testing.T) {
 		val := fmt.Sprintf("%d", i)
 		client.Write(key, val)
 		client = clients[(i + 1) % 3]
-		res, _ := client.Read(key)
+		res, _, _ := client.Read(key)
 		if res != val {
 			t.Fatalf("Cannot read last write!")
 		}
@@ -124,4 +135,122 @@ func TestSeqParallelRequests(t *testing.T) {
 	}
 
 	wg.Wait()
-}
\ No newline at end of file
+}
+
+func TestSequentialTTL(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+
+	clients[0].WriteWithTTL("session", "1", 200 * time.Millisecond)
+	if v, _, _ := clients[0].Read("session"); v != "1" {
+		t.Fatalf("Read session = %s before it expired", v)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if v, _, _ := clients[i].Read("session"); v != "nil" {
+			t.Fatalf("Read session = %s from %s after it expired", v, clients[i].ServerIface)
+		}
+	}
+}
+
+func TestSequentialMultiSetGet(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+
+	clients[1].MultiSet(map[string]string{"a": "1", "b": "2", "c": "3"})
+
+	// the batch is applied as one write, reading own writes sees all of it
+	got, _ := clients[1].MultiGet([]string{"a", "b", "c", "d"})
+	if len(got) != 3 || got["a"] != "1" || got["b"] != "2" || got["c"] != "3" {
+		t.Fatalf("Read %v", got)
+	}
+
+	// batch reads are ordered after the batch on every server
+	for i := 0; i < 3; i++ {
+		if got, _ := clients[i].MultiGet([]string{"a", "b", "c"}); len(got) != 3 || got["a"] != "1" {
+			t.Fatalf("Read %v from %s", got, clients[i].ServerIface)
+		}
+	}
+}
+
+func TestSequentialHistory(t *testing.T) {
+	recorder := checker.NewRecorder()
+	var clients [3]*checker.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = recorder.Client(i, &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false})
+	}
+
+	// keys of this run only, so every key starts missing
+	prefix := fmt.Sprintf("history-%d/", time.Now().UnixNano())
+
+	// every client writes and reads two keys on its own server
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				key := prefix + fmt.Sprintf("%d", j % 2)
+				if (i + j) % 3 == 0 {
+					clients[i].Write(key, fmt.Sprintf("%d-%d", i, j))
+				} else {
+					clients[i].Read(key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if result := checker.CheckSequential(recorder.History()); !result.Ok {
+		t.Fatal(result)
+	}
+}
+
+func TestSequentialPartition(t *testing.T) {
+	var clients [3]*services.Client
+	for i := 0; i < 3; i++ {
+		clients[i] = &services.Client{ServerIface: Cfg.ClientPorts[i], TrackVersion: false}
+	}
+	key := fmt.Sprintf("partition-%d", time.Now().UnixNano())
+
+	// server 3 is cut off, writes wait for the ack of every server
+	services.Partition(Cfg.ServerPorts[:2], Cfg.ServerPorts[2:])
+	defer services.Heal()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := clients[0].Write(key, "1")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Write completed across a partition: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// reads are local and keep being served on both sides
+	for i := 0; i < 3; i++ {
+		if v, _, err := clients[i].Read(key); err != nil || v != "nil" {
+			t.Fatalf("Read %s = %s from %s during the partition: %v", key, v, clients[i].ServerIface, err)
+		}
+	}
+
+	services.Heal()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Write failed after the partition healed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Write did not complete after the partition healed")
+	}
+	time.Sleep(time.Millisecond * 50)
+	if v, _, _ := clients[2].Read(key); v != "1" {
+		t.Fatalf("Read %s = %s from the healed server", key, v)
+	}
+}
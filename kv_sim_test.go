@@ -0,0 +1,220 @@
+package distkv
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"dist-kv/checker"
+	"dist-kv/protocol"
+	"dist-kv/services"
+	u "dist-kv/utils"
+)
+
+// seeds every simulation test explores
+const simSeeds = 30
+
+// runs three clients doing random writes, deletes and reads on a simulated cluster
+// every client waits for each reply before its next request
+func simulate(t *testing.T, level string, seed int64) (*services.Simulation, []checker.Operation) {
+	loadServerConfig()
+	Cfg = u.Config
+
+	sim, err := services.NewSimulation(level, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	workload := rand.New(rand.NewSource(seed))
+	keys := []string{"x", "y"}
+	var history []checker.Operation
+
+	var next func(client, left int, clock u.VectorClock)
+	next = func(client, left int, clock u.VectorClock) {
+		if left == 0 {
+			return
+		}
+		call := sim.Now() + time.Duration(workload.Intn(5))*time.Millisecond
+		req := &protocol.Request{Op: "get", Consistency: level, Key: keys[workload.Intn(len(keys))], Clock: clock.Copy()}
+		kind := checker.Read
+		switch workload.Intn(4) {
+		case 0:
+			req.Op = "del"
+			kind = checker.Write
+		case 1, 2:
+			req.Op = "set"
+			req.Value = fmt.Sprintf("%d-%d", client, left)
+			kind = checker.Write
+		}
+
+		sim.Request(call, client, req, func(reply *protocol.Reply) {
+			op := checker.Operation{Client: client, Kind: kind, Key: req.Key, Value: req.Value, Call: int64(call), Return: int64(sim.Now())}
+			if kind == checker.Read {
+				op.Value = reply.Value
+				if op.Value == "nil" {
+					op.Value = ""
+				}
+			}
+			if reply.Error != nil {
+				op.Return = math.MaxInt64
+			}
+			// failed reads returned nothing
+			if reply.Error == nil || kind == checker.Write {
+				history = append(history, op)
+			}
+			clock.Merge(reply.Clock)
+			next(client, left-1, clock)
+		})
+	}
+	for client := 0; client < 3; client++ {
+		next(client, 10, u.VectorClock{})
+	}
+
+	if !sim.Run(time.Minute) {
+		t.Fatalf("seed %d: requests still running after a minute", seed)
+	}
+	return sim, history
+}
+
+// the servers log every request, far too much over many seeds
+func quiet(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+func TestSimulatedLinearizable(t *testing.T) {
+	quiet(t)
+	for seed := int64(1); seed <= simSeeds; seed++ {
+		_, history := simulate(t, services.LinearizableLevel, seed)
+		if result := checker.CheckLinearizable(history); !result.Ok {
+			t.Fatalf("seed %d: %v", seed, result)
+		}
+	}
+}
+
+func TestSimulatedSequential(t *testing.T) {
+	quiet(t)
+	for seed := int64(1); seed <= simSeeds; seed++ {
+		_, history := simulate(t, services.SequentialLevel, seed)
+		if result := checker.CheckSequential(history); !result.Ok {
+			t.Fatalf("seed %d: %v", seed, result)
+		}
+	}
+}
+
+func TestSimulatedSequentialExpiry(t *testing.T) {
+	quiet(t)
+	loadServerConfig()
+	Cfg = u.Config
+	for seed := int64(1); seed <= simSeeds; seed++ {
+		sim, err := services.NewSimulation(services.SequentialLevel, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sim.Request(0, 0, &protocol.Request{Op: "set", Key: "x", Value: "1", TTL: 50}, nil)
+
+		// a read after the ttl on one server expires the key in the total order
+		var read string
+		sim.Request(time.Second, 1, &protocol.Request{Op: "get", Key: "x"}, func(reply *protocol.Reply) {
+			read = reply.Value
+		})
+		if !sim.Run(time.Minute) {
+			t.Fatalf("seed %d: requests still running after a minute", seed)
+		}
+		if read != "nil" {
+			t.Fatalf("seed %d: read x = %s after it expired", seed, read)
+		}
+		for i := 0; i < Cfg.NumServers; i++ {
+			if _, err := sim.Store(i).Get("x"); err != u.ErrNotFound {
+				t.Fatalf("seed %d: server %d still holds x after it expired", seed, i)
+			}
+		}
+	}
+}
+
+func TestSimulatedCausal(t *testing.T) {
+	quiet(t)
+	for seed := int64(1); seed <= simSeeds; seed++ {
+		_, history := simulate(t, services.CausalLevel, seed)
+		if result := checker.CheckCausal(history); !result.Ok {
+			t.Fatalf("seed %d: %v", seed, result)
+		}
+	}
+}
+
+func TestSimulatedEventual(t *testing.T) {
+	quiet(t)
+	for seed := int64(1); seed <= simSeeds; seed++ {
+		sim, _ := simulate(t, services.EventualLevel, seed)
+
+		// once the messages settle every server reads the same values
+		for _, key := range []string{"x", "y"} {
+			values := make([]string, Cfg.NumServers)
+			for i := range values {
+				i := i
+				sim.Request(sim.Now() + time.Second, i, &protocol.Request{Op: "get", Key: key}, func(reply *protocol.Reply) {
+					values[i] = reply.Value
+				})
+			}
+			sim.Run(sim.Now() + time.Minute)
+			for i := range values {
+				if values[i] != values[0] {
+					t.Fatalf("seed %d: servers read %s as %v", seed, key, values)
+				}
+			}
+		}
+	}
+}
+
+func TestSimulatedTombstones(t *testing.T) {
+	quiet(t)
+	loadServerConfig()
+	Cfg = u.Config
+	for _, level := range []string{services.EventualLevel, services.CausalLevel} {
+		for seed := int64(1); seed <= simSeeds; seed++ {
+			sim, err := services.NewSimulation(level, seed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// every ack arrives twice, a server hearing one peer twice
+			// has still not heard from the other
+			sim.Duplicate = 100
+
+			// the write is older than the delete but may reach the deleting
+			// server only after the acks of the third one
+			sim.Request(0, 2, &protocol.Request{Op: "set", Consistency: level, Key: "x", Value: "1"}, nil)
+			sim.Request(time.Millisecond, 0, &protocol.Request{Op: "del", Consistency: level, Key: "x"}, nil)
+			if !sim.Run(time.Minute) {
+				t.Fatalf("%s seed %d: requests still running after a minute", level, seed)
+			}
+
+			for i := 0; i < Cfg.NumServers; i++ {
+				if entry, err := sim.Store(i).Get("x"); err != u.ErrNotFound {
+					t.Fatalf("%s seed %d: server %d brought x = %s back after its delete", level, seed, i, entry.Value)
+				}
+			}
+		}
+	}
+}
+
+func TestSimulationReplay(t *testing.T) {
+	quiet(t)
+	for _, level := range []string{services.LinearizableLevel, services.SequentialLevel, services.EventualLevel, services.CausalLevel} {
+		first, history := simulate(t, level, 7)
+		second, replayed := simulate(t, level, 7)
+		// message ids are in the trace, they come from the rands of the servers
+		if !reflect.DeepEqual(first.Trace(), second.Trace()) || !reflect.DeepEqual(history, replayed) {
+			t.Fatalf("%s: seed 7 ran differently the second time", level)
+		}
+
+		other, _ := simulate(t, level, 8)
+		if reflect.DeepEqual(first.Trace(), other.Trace()) {
+			t.Fatalf("%s: seeds 7 and 8 ran the same", level)
+		}
+	}
+}
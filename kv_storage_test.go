@@ -0,0 +1,264 @@
+package distkv
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	u "dist-kv/utils"
+)
+
+// the same cases run against every storage engine, each on keys of its own
+var storeCases = []struct {
+	name string
+	run  func(t *testing.T, store u.Store)
+}{
+	{"versions count up", func(t *testing.T, store u.Store) {
+		store.Set("count", "1")
+		if entry, _ := store.Set("count", "2"); entry.Version != 2 {
+			t.Fatalf("Second set at version %d", entry.Version)
+		}
+		if entry, err := store.Get("count"); err != nil || entry.Value != "2" || entry.Version != 2 {
+			t.Fatalf("Read %v %v", entry, err)
+		}
+	}},
+	{"missing keys", func(t *testing.T, store u.Store) {
+		if _, err := store.Get("missing"); err != u.ErrNotFound {
+			t.Fatalf("Read of a missing key returned %v", err)
+		}
+		if err := store.Delete("missing"); err != nil {
+			t.Fatalf("Delete of a missing key returned %v", err)
+		}
+	}},
+	{"set after delete", func(t *testing.T, store u.Store) {
+		store.Set("again", "1")
+		store.Set("again", "2")
+		store.Delete("again")
+		if _, err := store.Get("again"); err != u.ErrNotFound {
+			t.Fatalf("Read of a deleted key returned %v", err)
+		}
+		// the version never goes back, a stale version can not come back
+		if entry, _ := store.Set("again", "3"); entry.Version != 3 {
+			t.Fatalf("Set after delete at version %d, want 3", entry.Version)
+		}
+	}},
+	{"put after delete", func(t *testing.T, store u.Store) {
+		store.Put("lww", "1", 5)
+		store.Delete("lww")
+		if ok, _ := store.Put("lww", "old", 5); ok {
+			t.Fatalf("Put at the deleted version was applied")
+		}
+		if ok, _ := store.Put("lww", "new", 6); !ok {
+			t.Fatalf("Put past the deleted version was refused")
+		}
+		if entry, _ := store.Get("lww"); entry.Value != "new" || entry.Version != 6 {
+			t.Fatalf("Read %v", entry)
+		}
+	}},
+	{"scan skips deleted keys", func(t *testing.T, store u.Store) {
+		store.Set("scan/a", "1")
+		store.Set("scan/b", "1")
+		store.Set("scan/c", "1")
+		store.Delete("scan/b")
+		entries, err := store.Scan("scan/", "scan0", 0)
+		if err != nil || len(entries) != 2 || entries[0].Key != "scan/a" || entries[1].Key != "scan/c" {
+			t.Fatalf("Scan returned %v %v", entries, err)
+		}
+	}},
+}
+
+func TestStores(t *testing.T) {
+	engines := []struct {
+		name string
+		open func(t *testing.T) u.Store
+	}{
+		{u.MemoryStorage, func(t *testing.T) u.Store {
+			return u.NewMemoryStore()
+		}},
+		{u.DiskStorage, func(t *testing.T) u.Store {
+			store, err := u.OpenDiskStore(t.TempDir(), u.FsyncNever, 0, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		}},
+		{u.RedisStorage, func(t *testing.T) u.Store {
+			if _, err := exec.LookPath("redis-server"); err != nil {
+				t.Skip("redis-server is not installed")
+			}
+			client, err := u.StartRedisClient(context.Background(), "16390")
+			if err != nil {
+				t.Skipf("redis is unavailable: %v", err)
+			}
+			return u.NewRedisStore(context.Background(), client, "16390")
+		}},
+	}
+
+	for _, engine := range engines {
+		t.Run(engine.name, func(t *testing.T) {
+			store := engine.open(t)
+			defer store.Close()
+			for _, c := range storeCases {
+				t.Run(c.name, func(t *testing.T) { c.run(t, store) })
+			}
+		})
+	}
+}
+
+func TestDiskStoreTombstones(t *testing.T) {
+	dir := t.TempDir()
+
+	// every record is followed by a snapshot, the tombstone lives in it
+	store, _ := u.OpenDiskStore(dir, u.FsyncAlways, 0, 1)
+	store.Set("x", "1")
+	store.Set("x", "2")
+	store.Delete("x")
+	store.Close()
+
+	store, _ = u.OpenDiskStore(dir, u.FsyncAlways, 0, 0)
+	// and now in the log
+	store.Set("y", "1")
+	store.Delete("y")
+	store.Close()
+
+	store, err := u.OpenDiskStore(dir, u.FsyncAlways, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if entry, _ := store.Set("x", "3"); entry.Version != 3 {
+		t.Fatalf("x set after restart at version %d, want 3", entry.Version)
+	}
+	if entry, _ := store.Set("y", "2"); entry.Version != 2 {
+		t.Fatalf("y set after restart at version %d, want 2", entry.Version)
+	}
+}
+
+func TestDiskStoreRecovery(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := u.OpenDiskStore(dir, u.FsyncAlways, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 3 records trigger a snapshot, the rest stays in the log
+	store.Set("x", "1")
+	store.Set("x", "2")
+	store.Set("y", "1")
+	store.Set("z", "1")
+	store.Delete("y")
+	store.Close()
+
+	// simulate a crash in the middle of appending a record
+	wal, _ := os.OpenFile(filepath.Join(dir, "wal.log"), os.O_WRONLY|os.O_APPEND, 0644)
+	wal.WriteString(`0badc0de {"op":"set","key":"x","val`)
+	wal.Close()
+
+	store, err = u.OpenDiskStore(dir, u.FsyncAlways, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	entry, err := store.Get("x")
+	if err != nil || entry.Value != "2" || entry.Version != 2 {
+		t.Fatalf("Expected x = 2 at version 2, got %v %v", entry, err)
+	}
+	if _, err := store.Get("y"); err != u.ErrNotFound {
+		t.Fatalf("Deleted key y was recovered")
+	}
+	if entry, _ := store.Get("z"); entry.Value != "1" {
+		t.Fatalf("Lost write to z after restart")
+	}
+
+	// the torn record was cut off, new writes keep their versions
+	entry, _ = store.Set("x", "3")
+	if entry.Version != 3 {
+		t.Fatalf("Expected version 3, got %d", entry.Version)
+	}
+}
+
+func TestMVCCSnapshots(t *testing.T) {
+	store := u.NewMemoryStore()
+	store.Set("x", "0")
+	mvcc := u.NewMVCC(store, 4)
+
+	before := mvcc.Seq()
+	mvcc.Commit([]u.Write{{Key: "x", Value: "1"}, {Key: "y", Value: "1"}})
+	mvcc.Commit([]u.Write{{Key: "x", Delete: true}})
+
+	// reads at the first snapshot see the value stored before any commit
+	if v, ok, _ := mvcc.ReadAt("x", before); !ok || v != "0" {
+		t.Fatalf("Read x = %s at snapshot %d", v, before)
+	}
+	if _, ok, _ := mvcc.ReadAt("y", before); ok {
+		t.Fatalf("Read y before it was written")
+	}
+	if v, _, _ := mvcc.ReadAt("x", before + 1); v != "1" {
+		t.Fatalf("Read x = %s at snapshot %d", v, before + 1)
+	}
+	if _, ok, _ := mvcc.ReadAt("x", mvcc.Seq()); ok {
+		t.Fatalf("Read x after its delete")
+	}
+	if changed, _ := mvcc.ChangedSince("y", before + 1); changed {
+		t.Fatalf("y reported changed after its last write")
+	}
+
+	// snapshots older than the retained commits are refused
+	for i := 0; i < 5; i++ {
+		mvcc.Commit([]u.Write{{Key: "z", Value: "1"}})
+	}
+	if _, _, err := mvcc.ReadAt("x", before); err != u.ErrSnapshotTooOld {
+		t.Fatalf("Read at an expired snapshot returned %v", err)
+	}
+	if v, ok, _ := mvcc.ReadAt("y", mvcc.Seq()); !ok || v != "1" {
+		t.Fatalf("Read y = %s after its versions were pruned", v)
+	}
+}
+
+// a store whose writes of one key fail
+type failingStore struct {
+	u.Store
+	key string
+}
+
+var errWriteFailed = errors.New("write failed")
+
+func (s failingStore) Set(key, value string) (u.Entry, error) {
+	if key == s.key {
+		return u.Entry{}, errWriteFailed
+	}
+	return s.Store.Set(key, value)
+}
+
+func TestMVCCFailedCommit(t *testing.T) {
+	store := u.NewMemoryStore()
+	store.Set("a", "0")
+	mvcc := u.NewMVCC(failingStore{store, "bad"}, 4)
+	mvcc.Commit([]u.Write{{Key: "a", Value: "1"}})
+
+	// the writes before the failing one are undone
+	seq := mvcc.Seq()
+	writes := []u.Write{{Key: "a", Value: "2"}, {Key: "b", Value: "2"}, {Key: "bad", Value: "2"}}
+	if _, err := mvcc.Commit(writes); err != errWriteFailed {
+		t.Fatalf("Commit returned %v", err)
+	}
+	if mvcc.Seq() != seq {
+		t.Fatalf("Failed commit moved the sequence to %d", mvcc.Seq())
+	}
+	if entry, _ := store.Get("a"); entry.Value != "1" {
+		t.Fatalf("Store holds a = %s after a failed commit", entry.Value)
+	}
+	if _, err := store.Get("b"); err != u.ErrNotFound {
+		t.Fatalf("Store holds b after a failed commit")
+	}
+	if v, _, _ := mvcc.ReadAt("a", seq); v != "1" {
+		t.Fatalf("Read a = %s after a failed commit", v)
+	}
+	if changed, _ := mvcc.ChangedSince("b", seq - 1); changed {
+		t.Fatalf("b reported changed by a failed commit")
+	}
+}
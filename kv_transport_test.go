@@ -0,0 +1,168 @@
+package distkv
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"dist-kv/services"
+	u "dist-kv/utils"
+)
+
+// a port nothing listens on yet
+func freePort(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+// reads frames from every connection accepted on the port
+// stop closes the listener along with its connections, like a crashed peer
+func receive(t *testing.T, port string) (stop func(), frames chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	stop = func() {
+		listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+
+	frames = make(chan string, 100)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go func() {
+				defer conn.Close()
+				for {
+					payload, err := u.ReadFrame(conn)
+					if err != nil {
+						return
+					}
+					frames <- string(payload)
+				}
+			}()
+		}
+	}()
+	return stop, frames
+}
+
+func expectFrame(t *testing.T, frames chan string, want string) {
+	select {
+	case got := <-frames:
+		if got != want {
+			t.Fatalf("Received %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Did not receive %q", want)
+	}
+}
+
+func TestTransportQueuesWhilePeerDown(t *testing.T) {
+	loadServerConfig()
+	port := freePort(t)
+	transport := services.NewTransport("transport-test")
+	defer transport.Close()
+
+	// nothing listens yet, the messages wait in the queue
+	for _, m := range []string{"1", "2", "3"} {
+		if err := transport.Send(port, []byte(m)); err != nil {
+			t.Fatalf("Send while the peer is down: %v", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if transport.LastError(port) == nil {
+		t.Fatalf("No error reported for a peer that is down")
+	}
+
+	// the peer comes up and gets every message in order
+	stop, frames := receive(t, port)
+	defer stop()
+	for _, m := range []string{"1", "2", "3"} {
+		expectFrame(t, frames, m)
+	}
+	if err := transport.LastError(port); err != nil {
+		t.Fatalf("Error %v reported after the peer came up", err)
+	}
+}
+
+func TestTransportReconnect(t *testing.T) {
+	loadServerConfig()
+	port := freePort(t)
+	transport := services.NewTransport("transport-test")
+	defer transport.Close()
+
+	stop, frames := receive(t, port)
+	transport.Send(port, []byte("before"))
+	expectFrame(t, frames, "before")
+
+	// the peer restarts, the transport redials it
+	stop()
+	time.Sleep(50 * time.Millisecond)
+	stop, frames = receive(t, port)
+	defer stop()
+
+	// a write into the dead connection may be lost, later ones arrive
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		transport.Send(port, []byte("after"))
+		select {
+		case got := <-frames:
+			if got != "after" {
+				t.Fatalf("Received %q after the restart", got)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	t.Fatalf("The transport did not reconnect to the restarted peer")
+}
+
+func TestTransportQueueLimit(t *testing.T) {
+	loadServerConfig()
+	port := freePort(t)
+	transport := services.NewTransport("transport-test")
+
+	// a peer that stays down fills its queue, then sends fail right away
+	// the link holds one more message, the one it keeps retrying
+	var err error
+	for i := 0; i <= 10001 && err == nil; i++ {
+		err = transport.Send(port, []byte("x"))
+	}
+	if !errors.Is(err, services.ErrQueueFull) {
+		t.Fatalf("Send to a full queue returned %v", err)
+	}
+
+	// closing waits for the link, even one backing off
+	closed := make(chan struct{})
+	go func() {
+		transport.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("Close did not return")
+	}
+	if err := transport.Send(port, []byte("x")); !errors.Is(err, services.ErrTransportClosed) {
+		t.Fatalf("Send after close returned %v", err)
+	}
+}
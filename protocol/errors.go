@@ -0,0 +1,59 @@
+package protocol
+
+import "fmt"
+
+// Code classifies a failed request
+// a code is an error itself, errors.Is(err, protocol.Timeout) tells if
+// err is an Error with that code
+type Code string
+
+const (
+	// the request is malformed or names an unknown op or level
+	BadRequest Code = "bad_request"
+	// the op is valid but the consistency mode does not serve it
+	Unsupported Code = "unsupported"
+	// the server gave up waiting, the request may still take effect
+	Timeout Code = "timeout"
+	// the server or the replicas it needs can not be reached
+	Unavailable Code = "unavailable"
+	// the server is not the raft leader and could not forward the request
+	NotLeader Code = "not_leader"
+	// the request lost against a concurrent one
+	Conflict Code = "conflict"
+	// the request or its response does not fit in a frame
+	TooLarge Code = "too_large"
+	// the store failed
+	Internal Code = "internal"
+)
+
+// Error is the error of a failed request as sent on the wire
+type Error struct {
+	Code    Code   `json:"code"`
+	Message string `json:"message"`
+}
+
+func Errorf(code Code, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// an error with the given code, err itself if it already is one
+func Wrap(code Code, err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return &Error{Code: code, Message: err.Error()}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// matches the code of the error
+func (e *Error) Is(target error) bool {
+	code, ok := target.(Code)
+	return ok && code == e.Code
+}
+
+func (c Code) Error() string {
+	return string(c)
+}
@@ -0,0 +1,159 @@
+package protocol
+
+import (
+	u "dist-kv/utils"
+)
+
+/*
+	Request is a client request
+	- Op picks the operation, the other fields are its arguments and
+	  are left out when unused
+	- every request carries a client generated ReqId, its reply carries
+	  the same one
+*/
+type Request struct {
+	ReqId       string `json:"reqId,omitempty"`
+	Op          string `json:"op"`
+	Consistency string `json:"consistency,omitempty"` // level on a mixed cluster
+
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+	TTL   int64  `json:"ttl,omitempty"` // milliseconds, zero keeps the key forever
+
+	// mget and mset
+	Keys   []string          `json:"keys,omitempty"`
+	Values map[string]string `json:"values,omitempty"`
+
+	// cas compares the value, the version or both
+	ExpectedValue   *string `json:"expectedValue,omitempty"`
+	ExpectedVersion *int64  `json:"expectedVersion,omitempty"` // a missing key is at version 0
+
+	// transactions
+	Snapshot int64     `json:"snapshot,omitempty"`
+	Writes   []u.Write `json:"writes,omitempty"`
+
+	// scans, end is exclusive and empty for no upper bound
+	Start  string `json:"start,omitempty"`
+	End    string `json:"end,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+
+	// writes the client has seen, causal only
+	Clock u.VectorClock `json:"clock,omitempty"`
+
+	Since  int64  `json:"since,omitempty"`  // watch resumes after this revision
+	Watch  string `json:"watch,omitempty"`  // reqId of the watch an unwatch ends
+	Offset int64  `json:"offset,omitempty"` // first change a changes read returns
+
+	// server port of the raft follower that forwarded the request
+	Forwarded string `json:"forwarded,omitempty"`
+}
+
+// Reply answers a request, only the fields of its op are set
+type Reply struct {
+	ReqId string `json:"reqId,omitempty"`
+	Error *Error `json:"error,omitempty"`
+
+	Value   string `json:"value,omitempty"`
+	Version int64  `json:"version,omitempty"`
+	Found   bool   `json:"found,omitempty"` // txget
+
+	// causal reads, the writes the result depends on
+	Clock      u.VectorClock `json:"clock,omitempty"`
+	Concurrent bool          `json:"concurrent,omitempty"` // the value won over a concurrent write
+
+	Values map[string]string `json:"values,omitempty"` // mget, missing keys are left out
+
+	Swapped   bool   `json:"swapped,omitempty"`   // cas
+	Snapshot  int64  `json:"snapshot,omitempty"`  // begin
+	Committed bool   `json:"committed,omitempty"` // txn
+	Commit    int64  `json:"commit,omitempty"`    // sequence of the commit
+	Conflict  string `json:"conflict,omitempty"`  // key written after the snapshot
+	TTL       int64  `json:"ttl,omitempty"`       // milliseconds left, -1 without expiry, -2 missing
+	Persisted bool   `json:"persisted,omitempty"`
+
+	// scans, the cursor is empty on the last page
+	Entries []u.Entry `json:"entries,omitempty"`
+	Cursor  string    `json:"cursor,omitempty"`
+
+	// watch streams
+	Watching  bool   `json:"watching,omitempty"` // the first reply of a watch
+	Revision  int64  `json:"revision,omitempty"` // the watch starts after it
+	Event     *Event `json:"event,omitempty"`
+	Done      bool   `json:"done,omitempty"` // the last reply of a watch
+	Unwatched bool   `json:"unwatched,omitempty"`
+
+	// change log reads
+	Changes []Event `json:"changes,omitempty"`
+	Next    int64   `json:"next,omitempty"`
+	First   int64   `json:"first,omitempty"`
+}
+
+// Event is a change applied to the store of a node
+type Event struct {
+	Revision int64  `json:"revision"` // position in the changes of the node
+	Op       string `json:"op"`       // set or del
+	Key      string `json:"key"`
+	Value    string `json:"value,omitempty"`
+	Version  int64  `json:"version"` // version of the key, the last one for a delete
+}
+
+/*
+	Peer is a client request replicated to the other servers, or the
+	acknowledgement of one
+	- Id names the request on every server
+	- Timestamp orders it in the hybrid logical clock protocols,
+	  Clock holds its dependencies in the causal one
+	- an ack carries the request it acknowledges
+*/
+type Peer struct {
+	Request   Request       `json:"request"`
+	Id        string        `json:"id"`
+	Origin    string        `json:"origin"` // server port the request arrived at
+	Timestamp u.Timestamp   `json:"timestamp"`
+	Clock     u.VectorClock `json:"clock,omitempty"`
+
+	Ack     bool          `json:"ack,omitempty"`
+	From    string        `json:"from,omitempty"`    // server port sending the ack
+	Applied u.VectorClock `json:"applied,omitempty"` // writes the acking server had applied, causal only
+}
+
+// RaftEntry is a client request in the replicated log of raft
+type RaftEntry struct {
+	Term    int64   `json:"term"`
+	Id      string  `json:"id"`
+	Request Request `json:"request"`
+	// wall clock of the leader in milliseconds, never behind an earlier entry
+	// keys expire at the timestamp of their write plus the ttl
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+// RaftMessage is every raft rpc and its reply
+type RaftMessage struct {
+	Type string `json:"type"` // requestVote, vote, appendEntries, appendReply
+	Term int64  `json:"term"`
+	From string `json:"from"`
+
+	LastLogIndex int   `json:"lastLogIndex,omitempty"`
+	LastLogTerm  int64 `json:"lastLogTerm,omitempty"`
+	Granted      bool  `json:"granted,omitempty"`
+
+	PrevLogIndex int         `json:"prevLogIndex,omitempty"`
+	PrevLogTerm  int64       `json:"prevLogTerm,omitempty"`
+	Entries      []RaftEntry `json:"entries,omitempty"`
+	LeaderCommit int         `json:"leaderCommit,omitempty"`
+	Success      bool        `json:"success,omitempty"`
+	// on success the last replicated index, on failure a hint where to retry from
+	MatchIndex int `json:"matchIndex,omitempty"`
+}
+
+// QuorumMessage is a replica request of a quorum coordinator and its reply
+type QuorumMessage struct {
+	Op      string `json:"op"` // replicate, replicated, fetch or fetched
+	ReqId   string `json:"reqId"`
+	From    string `json:"from"`
+	Key     string `json:"key,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Version int64  `json:"version,omitempty"` // zero for a missing key
+}
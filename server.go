@@ -2,6 +2,7 @@ package distkv
 
 import (
 	"encoding/json"
+	"log"
 	"os"
 
 	u "dist-kv/utils"
@@ -13,17 +14,43 @@ const (
 	Sequential = 2
 	Eventual = 3
 	Causal = 4
+	Raft = 5
+	Quorum = 6
+	Mixed = 7 // consistency picked per request
 )
 
 var ServersUp = false
 var Cfg u.ServerConfig
 
+// starts one server of the running cluster
+var startServer func(string, string, string) error
+
 func StartServers(consistency int) {
+	StartCluster(consistency, 0)
+}
+
+// like StartServers with numServers servers, 0 keeps the number in config.json
+func StartCluster(consistency, numServers int) {
+	// tear down servers started by an earlier call
+	if ServersUp {
+		Shutdown()
+	}
+
 	loadServerConfig()
+	if numServers > 0 {
+		u.Config.NumServers = numServers
+	}
 	Cfg = u.Config
 
 	var server func(string, string, string) error
 
+	// a new cluster starts without the raft state of an earlier one
+	if consistency == Raft {
+		for i := 0; i < u.Config.NumServers; i++ {
+			s.RemoveRaftState(Cfg.ServerPorts[i])
+		}
+	}
+
 	switch consistency {
 	case Linearizable:
 		server = s.StartLinearizableServer
@@ -33,20 +60,46 @@ func StartServers(consistency int) {
 		server = s.StartEventualServer
 	case Causal:
 		server = s.StartCausalServer
+	case Raft:
+		server = s.StartRaftServer
+	case Quorum:
+		server = s.StartQuorumServer
+	case Mixed:
+		server = s.StartMixedServer
 	default:
 		server = s.StartLinearizableServer
 	}
 
+	startServer = server
 	for i := 0; i < u.Config.NumServers; i++ {
 		// starting three servers
-		go server(Cfg.ClientPorts[i], Cfg.ServerPorts[i], Cfg.KvStorePorts[i])
+		go runServer(i)
 	}
 
 	ServersUp = true
 }
 
+func runServer(i int) {
+	err := startServer(Cfg.ClientPorts[i], Cfg.ServerPorts[i], Cfg.KvStorePorts[i])
+	if err != nil {
+		log.Printf("Server on %s stopped: %v\n", Cfg.ClientPorts[i], err)
+	}
+}
+
 func Shutdown() {
 	s.KillAll()
+	ServersUp = false
+}
+
+// stops the i-th server, the others keep running
+func KillServer(i int) {
+	s.KillServer(Cfg.ServerPorts[i])
+	u.StopStore(Cfg.KvStorePorts[i])
+}
+
+// starts the i-th server again after KillServer, with whatever it saved
+func RestartServer(i int) {
+	go runServer(i)
 }
 
 func loadServerConfig() {
@@ -0,0 +1,50 @@
+package services
+
+import (
+	"sort"
+
+	"dist-kv/protocol"
+	u "dist-kv/utils"
+)
+
+// largest number of keys in one mget or mset
+const maxBatchKeys = 1000
+
+// keys of an mget request
+// format {op: 'mget', keys: ["k1", "k2"]}
+func parseKeys(message *protocol.Request) ([]string, *protocol.Error) {
+	if len(message.Keys) > maxBatchKeys {
+		return nil, protocol.Errorf(protocol.TooLarge, "Too many keys in one request")
+	}
+	return message.Keys, nil
+}
+
+// writes of an mset request in key order
+// format {op: 'mset', values: {"k1": "v1", "k2": "v2"}}
+func parseValues(message *protocol.Request) ([]u.Write, *protocol.Error) {
+	if len(message.Values) > maxBatchKeys {
+		return nil, protocol.Errorf(protocol.TooLarge, "Too many keys in one request")
+	}
+
+	writes := make([]u.Write, 0, len(message.Values))
+	for k, v := range message.Values {
+		writes = append(writes, u.Write{Key: k, Value: v})
+	}
+	sort.Slice(writes, func(i, j int) bool { return writes[i].Key < writes[j].Key })
+	return writes, nil
+}
+
+// reads every key into a reply, missing keys are left out
+func serveBatch(kvStore u.Store, keys []string) *protocol.Reply {
+	values := map[string]string{}
+	for _, key := range keys {
+		entry, err := kvStore.Get(key)
+		if err == u.ErrNotFound {
+			continue
+		} else if err != nil {
+			return failed(storeError(err))
+		}
+		values[key] = entry.Value
+	}
+	return &protocol.Reply{Values: values}
+}
@@ -3,212 +3,407 @@ package services
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"math/rand"
-	"net"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"dist-kv/protocol"
 	u "dist-kv/utils"
+)
+
+// how long a request waits for the writes its client has seen
+const causalWaitTimeout = 5 * time.Second
+
+var errCausalTimeout = errors.New("timed out waiting for causal dependencies")
 
-	"github.com/redis/go-redis/v9"
+// a causal server started again after it was killed
+var ErrCausalRestart = errors.New("causal server can not restart")
+
+var (
+	causalMu sync.Mutex
+	// servers that ran the causal protocol since the cluster started
+	causalRan = map[string]bool{}
 )
 
 /*
-	- Causal order broadcast
+	- Causal order broadcast with vector clocks
+	- Every write carries the vector clock of everything it depends on
+	- A remote write is applied only after all of its dependencies,
+	  until then it waits in a pending buffer
+	- Clients carry their causal context and a server serves them
+	  only once it has applied everything the client has seen
+	- Concurrent writes to a key are detected, every replica keeps the
+	  same winner and reports the conflict on reads
+	- Deletes are writes too, the key keeps its metadata as a tombstone
+	  until every replica has applied the delete
+	- Keys never expire: writes with a ttl, ttl and persist are rejected
+	  as Unsupported, there is no order replicas could agree to expire in
+	- A killed server can not be restarted, it fails with ErrCausalRestart.
+	  The writes it applied are known in memory only, a restarted server
+	  would wait forever for writes its peers sent before it went down
 */
 func StartCausalServer(clientIface, serverIface, kvStoreIface string) error {
-	// config accessor
-	cfg := u.Config
+	if err := claimCausal(serverIface); err != nil {
+		return err
+	}
 	ctx := context.Background()
 
-	kvStore, err := u.StartRedisClient(ctx, kvStoreIface)
+	kvStore, err := u.StartStore(ctx, kvStoreIface)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// changes applied to the store are streamed to watchers
+	hub := newWatchHub()
+	kvStore = hub.watch(kvStore)
 
 	// fmt.Printf("Server listeneing on ports: %s | %s\n", clientIface, serverIface)
-	listener, _ := net.Listen(cfg.NetType, cfg.NetAddr + ":" + clientIface)
-	intListener, _ := net.Listen(cfg.NetType, cfg.NetAddr + ":" + serverIface) // internal listener
+	listener, err := listen(clientIface, serverIface)
+	if err != nil {
+		return err
+	}
+	intListener, err := listen(serverIface, serverIface) // internal listener
+	if err != nil {
+		return err
+	}
+	transport := NewTransport(serverIface)
+
+	handleRequest, handlePeer := newCausal(clientIface, serverIface, kvStore, transport, realClock{}, newRand())
+	go servePeers(intListener, handlePeer)
+
+	// handle connections until the server is killed
+	return serveClients(listener, handleRequest, hub)
+}
+
+// records that the server runs the causal protocol, it may only do so once
+func claimCausal(serverIface string) error {
+	causalMu.Lock()
+	defer causalMu.Unlock()
+	if causalRan[serverIface] {
+		return ErrCausalRestart
+	}
+	causalRan[serverIface] = true
+	return nil
+}
+
+// a new cluster starts every server afresh
+func forgetCausal() {
+	causalMu.Lock()
+	defer causalMu.Unlock()
+	causalRan = map[string]bool{}
+}
+
+// handlers of the causal protocol over the given store, message bus and clock
+// the clock is named wall, clock is a vector clock everywhere else here
+func newCausal(clientIface, serverIface string, kvStore u.Store, bus Bus, wall Clock, r *rand.Rand) (requestHandler, peerHandler) {
+	// config accessor
+	cfg := u.Config
+	// ids of the messages this server sends
+	nextId := newIds(serverIface, r)
 
 	var mu sync.Mutex
-	connQ := make(chan net.Conn, 1000)
+	// writes applied from every server
+	applied := u.VectorClock{}
+	// stamps every write, a write is stamped after every write it depends on
+	hlc := newHLC(wall)
+	// causal metadata of the writes applied to each key
+	keys := map[string]*causalKey{}
+	// remote writes waiting for their dependencies
+	pending := []*protocol.Peer{}
+	// deletes and the replicas that have seen them, by message id
+	tombstones := map[string]*tombstone{}
+
+	// applies a write with its clock, callers hold mu
+	apply := func(message *protocol.Peer) {
+		req := &message.Request
+		clock := message.Clock
+		meta, ok := keys[req.Key]
+		if !ok {
+			meta = &causalKey{clock: u.VectorClock{}}
+			keys[req.Key] = meta
+		}
 
-	// register connection handler for server-to-server broadcasts 
-	go func() {
-		for {
-			conn, _ := intListener.Accept()
-			// log.Printf("Received msg %s at %s\n", string(buffer), serverIface)
-
-			go func(conn net.Conn) {
-				defer conn.Close()
-				buffer := make([]byte, cfg.PayloadSize)
-				size, _ := conn.Read(buffer)
-
-				message := map[string]string{}
-				json.Unmarshal(buffer[:size], &message)
-				message["op"] = strings.ToLower(message["op"])
-
-				// only write messages are broadcasted
-				if message["op"] == "set" {
-					// check for dependency write!
-					msgDependency, ok := message["dependency"]
-					if ok && msgDependency != "{}" && msgDependency != "" {
-						dependency := make(map[string]string)
-						json.Unmarshal([]byte(msgDependency), &dependency)
-
-						// wait for until the dependent write operation is done
-						// before appyling the current write operation
-						for {
-							time.Sleep(time.Millisecond * time.Duration(rand.Intn(20)))
-							mu.Lock()
-							valStr, err := kvStore.Get(ctx, dependency["key"]).Result()
-							mu.Unlock()
-							if err != redis.Nil {
-								val := make(map[string]string)
-								json.Unmarshal([]byte(valStr), &val)
-								// dependent write is complete
-								// log.Printf("Val: %s, Dependency: %s at %s\n", valStr, msgDependency, serverIface)
-								if val["version"] == dependency["version"] {
-									// log.Printf("Dependent write %s version %s done\n", dependency["key"], dependency["version"])
-									break
-								}
-							}
-						}
-					}
+		// timestamps follow causality, so the latest write wins on every
+		// replica whatever order concurrent writes arrive in
+		ts := message.Timestamp
+		if meta.ts.Less(ts) || (ts == meta.ts && message.Origin > meta.origin) {
+			// a mixed server skips a write a later one of another level overtook
+			if req.Op == "del" {
+				// the metadata stays behind as the tombstone
+				applyAt(kvStore, ts, message.Origin, u.Write{Key: req.Key, Delete: true})
+				meta.tombstone = message.Id
+			} else {
+				// store bumps the version of the key
+				applyAt(kvStore, ts, message.Origin, u.Write{Key: req.Key, Value: req.Value})
+				meta.tombstone = ""
+			}
+			meta.ts = ts
+			meta.origin = message.Origin
+		}
+		meta.concurrent = !clock.Descends(meta.clock)
+		meta.clock.Merge(clock)
 
-					mu.Lock()
-					// log.Printf("Writing %v at %s\n", message, serverIface)
-					val, err := kvStore.Get(ctx, message["key"]).Result()
-
-					// no key exists
-					var newVersion int
-					if err == redis.Nil {
-						newVersion = 0
-					} else {
-						result := make(map[string]string)
-						json.Unmarshal([]byte(val), &result)
-						newVersion, _ = strconv.Atoi(result["version"])
-					}
-					newVersion++
+		applied[message.Origin] = clock[message.Origin]
+	}
 
-					rawObj, _ := json.Marshal(map[string]string{
-						"value": message["value"],
-						"version": strconv.Itoa(newVersion),
-					})
+	// the next write of its origin whose dependencies are all applied
+	// callers hold mu
+	deliverable := func(message *protocol.Peer) bool {
+		clock := message.Clock
+		origin := message.Origin
+		if clock[origin] != applied[origin] + 1 {
+			return false
+		}
+		for k, v := range clock {
+			if k != origin && v > applied[k] {
+				return false
+			}
+		}
+		return true
+	}
 
-					kvStore.Set(ctx, message["key"], string(rawObj), 0)
-					mu.Unlock()
+	// the tombstone of a delete, created before it is acknowledged
+	// callers hold mu
+	track := func(message *protocol.Peer) *tombstone {
+		t, ok := tombstones[message.Id]
+		if !ok {
+			t = &tombstone{key: message.Request.Key, acks: map[string]bool{}, clock: u.VectorClock{}}
+			tombstones[message.Id] = t
+		}
+		return t
+	}
+
+	// drops tombstones every other replica has acknowledged, once this one
+	// has applied every write the acknowledging replicas had applied
+	// a write concurrent with the delete can only come from those, so it
+	// meets the tombstone rather than resurrecting the key
+	// callers hold mu
+	collect := func() {
+		for id, t := range tombstones {
+			if len(t.acks) < cfg.NumServers - 1 || !applied.Descends(t.clock) {
+				continue
+			}
+			if meta, ok := keys[t.key]; ok && meta.tombstone == id {
+				delete(keys, t.key)
+			}
+			delete(tombstones, id)
+		}
+	}
+
+	// tells every other replica this one has applied the delete
+	// callers hold mu
+	ack := func(message *protocol.Peer) {
+		ackMsg := *message
+		ackMsg.Ack = true
+		ackMsg.From = serverIface
+		ackMsg.Applied = applied.Copy()
+		jsonMsg, _ := json.Marshal(ackMsg)
+		if err := bus.Broadcast(jsonMsg, false); err != nil {
+			log.Printf("Broadcast from %s failed: %v\n", serverIface, err)
+		}
+	}
 
+	// blocks until the server has applied everything in the clock
+	waitFor := func(clock u.VectorClock) bool {
+		deadline := wall.Now().Add(causalWaitTimeout)
+		for {
+			mu.Lock()
+			done := applied.Descends(clock)
+			mu.Unlock()
+			if done {
+				return true
+			}
+			if wall.Now().After(deadline) {
+				return false
+			}
+			wall.Sleep(time.Millisecond * 5)
+		}
+	}
+
+	// handler for server-to-server broadcasts
+	// messages from one peer are handled in the order they were sent
+	handlePeer := func(message *protocol.Peer) {
+		op := strings.ToLower(message.Request.Op)
+		message.Request.Op = op
+
+		// every received message moves the clock past its timestamp
+		hlc.Update(message.Timestamp)
+
+		if message.Ack {
+			mu.Lock()
+			t := track(message)
+			// a duplicated ack counts once
+			t.acks[message.From] = true
+			t.clock.Merge(message.Applied)
+			collect()
+			mu.Unlock()
+			return
+		}
+
+		// only write messages are broadcasted
+		if op != "set" && op != "del" {
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		pending = append(pending, message)
+
+		// applying one write may unblock others
+		for progress := true; progress; {
+			progress = false
+			for i, m := range pending {
+				if deliverable(m) {
+					// log.Printf("Writing %v at %s\n", m, serverIface)
+					apply(m)
+					pending = append(pending[:i], pending[i+1:]...)
+					if m.Request.Op == "del" {
+						track(m)
+						ack(m)
+					}
+					progress = true
+					break
 				}
-				conn.Close()
+			}
+		}
+		collect()
+	}
 
-			}(conn)
+	// handler for client-to-server requests
+	// requests sharing a connection are served concurrently
+	handleRequest := func(message *protocol.Request) *protocol.Reply {
+		// format {op: 'set', key: key, value: value, clock: clock}
+		// format {op: 'get', key: key, clock: clock}
+		// format {op: 'del', key: key, clock: clock}
+		// format {op: 'scan', start: key, end: key, prefix: prefix, limit: n, cursor: cursor, clock: clock}
+		message.Op = strings.ToLower(message.Op)
+		// add timestamp to the request
+		timestamp := wall.Now().UnixMilli()
+
+		if message.TTL != 0 {
+			return failed(clientError("ttl"))
 		}
-	}()
-
-	// connection handler for client-to-server messages
-	go func() {
-		for conn := range connQ {
-			// handle connection here
-			buffer := make([]byte, cfg.PayloadSize)
-			size, _ := conn.Read(buffer)
-
-			// format {op: 'set', key: key, value: value}
-			// format {op: 'get', key: key}
-			message := make(map[string]string)
-			json.Unmarshal(buffer[:size], &message)
-
-			message["op"] = strings.ToLower(message["op"])
-			// add unique message id
-			message["id"] = strconv.Itoa(rand.Int())
-			// add timestamp to the request
-			timestamp := time.Now().UnixMilli()
-			message["timestamp"] = strconv.FormatInt(timestamp, 10)
-
-			if message["op"] != "set" && message["op"] != "get" {
-				message["error"] = "Client Error!"
+
+		if message.Op != "set" && message.Op != "get" && message.Op != "del" && message.Op != "scan" {
+			return failed(clientError(message.Op))
+		}
+
+		// the client may have seen writes this server has not applied yet
+		if !waitFor(message.Clock) {
+			return failed(protocol.Wrap(protocol.Timeout, errCausalTimeout))
+		}
+
+		reply := &protocol.Reply{}
+		if message.Op == "set" || message.Op == "del" {
+			if message.Op == "set" {
+				log.Printf("%d Start : Write %s = %s  at server %s\n",
+					timestamp, message.Key, message.Value, clientIface)
 			} else {
-				mu.Lock()
-				val, err := kvStore.Get(ctx, message["key"]).Result()
+				log.Printf("%d Start : Delete %s at server %s\n",
+					timestamp, message.Key, clientIface)
+			}
+
+			mu.Lock()
+			// the write depends on everything applied here
+			applied[serverIface]++
+			broadcast := &protocol.Peer{
+				Request: *message,
+				// add unique message id
+				Id: nextId(),
+				Origin: serverIface,
+				Clock: applied.Copy(),
+				Timestamp: hlc.Now(),
+			}
+			// the client context is carried by the clock of the write
+			broadcast.Request.Clock = nil
+			apply(broadcast)
+			entry, _ := kvStore.Get(message.Key)
+
+			jsonMsg, _ := json.Marshal(broadcast)
+			// broadcast message and do not include itself!
+			if err := bus.Broadcast(jsonMsg, false); err != nil {
+				// applied here, the other replicas may never see it
 				mu.Unlock()
+				log.Printf("Broadcast from %s failed: %v\n", serverIface, err)
+				return failed(protocol.Wrap(protocol.Unavailable, err))
+			}
+			if message.Op == "del" {
+				// the ack follows the delete on every peer link
+				track(broadcast)
+				ack(broadcast)
+			}
+			mu.Unlock()
 
-				if message["op"] == "set" {
-					log.Printf("%d Start : Write %s = %s  at server %s\n", 
-						timestamp, message["key"], message["value"], clientIface)
-					// no key exists
-					var newVersion int
-					if err == redis.Nil {
-						newVersion = 0
-					} else {
-						result := make(map[string]string)
-						json.Unmarshal([]byte(val), &result)
-						newVersion, _ = strconv.Atoi(result["version"])
-					}
-					newVersion++
-
-					rawObj, _ := json.Marshal(map[string]string{
-						"value": message["value"],
-						"version": strconv.Itoa(newVersion),
-					})
-	
-					mu.Lock()
-					kvStore.Set(ctx, message["key"], string(rawObj), 0)
-					mu.Unlock()
-
-					jsonMsg, _ := json.Marshal(message)
-					// broadcast message and do not include itself!
-					BroadcastMsg(jsonMsg, serverIface, false, 8)
-
-					message["version"] = strconv.Itoa(newVersion)
-					log.Printf("%d End   : Write %s = %s version %s at server %s\n",
-						time.Now().UnixMilli(), message["key"], message["value"], message["version"], clientIface)
-
-				} else if message["op"] == "get" {
-					log.Printf("%d Start : Read %s with min version %s at server %s\n", 
-						timestamp, message["key"], message["minVersion"], clientIface)
-					// minimum version
-					result := make(map[string]string)
-					currentVersion := -1
-					minVersion, _ := strconv.Atoi(message["minVersion"])
-
-					for currentVersion < minVersion {
-						time.Sleep(time.Millisecond * 5)
-
-						mu.Lock()
-						val, err := kvStore.Get(ctx, message["key"]).Result()
-						mu.Unlock()
-
-						if err == redis.Nil {
-							message["value"] = "nil"
-							currentVersion = 0
-							break
-						} else {
-							json.Unmarshal([]byte(val), &result)
-							message["value"] = result["value"]
-							currentVersion, _ = strconv.Atoi(result["version"])
-						}
-					}
+			reply.Clock = broadcast.Clock
+			reply.Version = entry.Version
+			if message.Op == "set" {
+				log.Printf("%d End   : Write %s = %s version %d at server %s\n",
+					wall.Now().UnixMilli(), message.Key, message.Value, reply.Version, clientIface)
+			} else {
+				log.Printf("%d End   : Delete %s at server %s\n",
+					wall.Now().UnixMilli(), message.Key, clientIface)
+			}
 
-					message["version"] = strconv.Itoa(currentVersion)
-					log.Printf("%d End   : Read %s = %s version %s at server %s\n",
-						time.Now().UnixMilli(), message["key"], message["value"], message["version"], clientIface)
+		} else if message.Op == "scan" {
+			log.Printf("%d Start : Scan [%s, %s) with clock %v at server %s\n",
+				timestamp, message.Start, message.End, message.Clock, clientIface)
+
+			mu.Lock()
+			page, err := scanStore(kvStore, parseScan(message))
+			// the page depends on the writes of every key in it
+			clock := u.VectorClock{}
+			for _, entry := range page.Entries {
+				if meta, ok := keys[entry.Key]; ok {
+					clock.Merge(meta.clock)
 				}
-	
-				message["errors"] = ""
 			}
+			mu.Unlock()
 
-			res, _ := json.Marshal(message)
-			conn.Write(res)
-			conn.Close()
+			if err != nil {
+				return failed(storeError(err))
+			}
+			reply = pageReply(page)
+			reply.Clock = clock
+
+			log.Printf("%d End   : Scan [%s, %s) cursor %s at server %s\n",
+				wall.Now().UnixMilli(), message.Start, message.End, reply.Cursor, clientIface)
+
+		} else if message.Op == "get" {
+			log.Printf("%d Start : Read %s with clock %v at server %s\n",
+				timestamp, message.Key, message.Clock, clientIface)
+
+			mu.Lock()
+			entry, err := kvStore.Get(message.Key)
+			if meta, ok := keys[message.Key]; ok {
+				reply.Clock = meta.clock.Copy()
+				reply.Concurrent = meta.concurrent
+			}
+			mu.Unlock()
+
+			if err == u.ErrNotFound {
+				reply.Value = "nil"
+			} else {
+				reply.Value = entry.Value
+				reply.Version = entry.Version
+			}
+
+			log.Printf("%d End   : Read %s = %s version %d at server %s\n",
+				wall.Now().UnixMilli(), message.Key, reply.Value, reply.Version, clientIface)
 		}
-	}()
 
-	// handle connections
-	for {
-		conn, _ := listener.Accept()
-		connQ <- conn
+		return reply
 	}
-}
\ No newline at end of file
+
+	return handleRequest, handlePeer
+}
+
+// causal metadata of the writes applied to a key
+type causalKey struct {
+	clock      u.VectorClock // merged clocks of every applied write
+	ts         u.Timestamp   // timestamp and origin of the winning write
+	origin     string
+	concurrent bool   // the last write did not see every earlier one
+	tombstone  string // id of the delete that won, empty while the key holds a value
+}
@@ -0,0 +1,150 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+
+	"dist-kv/protocol"
+	u "dist-kv/utils"
+)
+
+// changes kept per node when ChangeLogRetain is not set
+const DefaultChangeLogRetain = 100000
+
+// largest number of changes in one read of the log
+const maxChangesLimit = 1000
+
+var errChangesCompacted = errors.New("offset is older than the retained changes")
+
+/*
+	Change data capture log of one node
+	- every change applied to the store of the node is appended in the
+	  order the node applied it, which is the delivery order of the
+	  priority queue in linearizable and sequential modes and the apply
+	  order in eventual, causal, quorum and raft modes
+	- the offset of a change is its revision, the first change has offset 1
+	- the oldest changes are dropped past the retained count, offsets
+	  are never reused
+	- an mset or transaction appends one change per key it writes
+
+	The log is read with
+	  {op: 'changes', offset: first offset, limit: n}
+	and answered with
+	  {changes: [change], next: offset to read next, first: oldest retained offset}
+	a delete carries the version of the value it removed
+	reading past the end returns no changes and the same next offset,
+	a watch on the empty prefix follows the log live
+
+	ExportChanges writes changes as JSON lines, one change per line
+	  {"revision":7,"op":"set","key":"k","value":"v","version":3}
+	  {"revision":8,"op":"del","key":"k","version":3}
+*/
+type changeLog struct {
+	retain  int
+	changes []WatchEvent // oldest first, offsets are contiguous
+}
+
+func newChangeLog(retain int) *changeLog {
+	if retain <= 0 {
+		retain = DefaultChangeLogRetain
+	}
+	return &changeLog{retain: retain}
+}
+
+func (l *changeLog) append(change WatchEvent) {
+	l.changes = append(l.changes, change)
+	if len(l.changes) > l.retain {
+		// copy so the dropped changes can be collected
+		l.changes = append([]WatchEvent(nil), l.changes[len(l.changes) - l.retain:]...)
+	}
+}
+
+// offset of the oldest retained change, or of the next one if there are none
+func (l *changeLog) first(last int64) int64 {
+	if len(l.changes) == 0 {
+		return last + 1
+	}
+	return l.changes[0].Revision
+}
+
+// up to limit changes starting at offset
+func (l *changeLog) read(offset int64, limit int, last int64) ([]WatchEvent, error) {
+	first := l.first(last)
+	if offset < first {
+		return nil, errChangesCompacted
+	}
+	if offset > last {
+		return nil, nil
+	}
+	start := int(offset - first)
+	end := start + limit
+	if end > len(l.changes) {
+		end = len(l.changes)
+	}
+	return l.changes[start:end], nil
+}
+
+// serves a read of the change log
+// format {op: 'changes', offset: offset, limit: n}
+func serveChanges(hub *watchHub, message *protocol.Request) *protocol.Reply {
+	offset := int64(1)
+	if message.Offset < 0 {
+		return failed(protocol.Errorf(protocol.BadRequest, "Malformed offset: %d", message.Offset))
+	} else if message.Offset > 0 {
+		offset = message.Offset
+	}
+	limit := defaultScanLimit
+	if message.Limit < 0 {
+		return failed(protocol.Errorf(protocol.BadRequest, "Malformed limit: %d", message.Limit))
+	} else if message.Limit > 0 {
+		limit = message.Limit
+	}
+	if limit > maxChangesLimit {
+		limit = maxChangesLimit
+	}
+
+	changes, first, err := hub.changes(offset, limit)
+	if err != nil {
+		return &protocol.Reply{Error: protocol.Wrap(protocol.BadRequest, err), First: first}
+	}
+
+	// large values end the page early so the response fits in a frame
+	size := 0
+	for i, change := range changes {
+		encoded, _ := json.Marshal(change)
+		if i > 0 && size + len(encoded) > u.MaxFrameSize() / 2 {
+			changes = changes[:i]
+			break
+		}
+		size += len(encoded)
+	}
+	return &protocol.Reply{
+		Changes: changes,
+		Next: offset + int64(len(changes)),
+		First: first,
+	}
+}
+
+// writes the changes as JSON lines, one change per line
+func ExportChanges(w io.Writer, changes []WatchEvent) error {
+	encoder := json.NewEncoder(w)
+	for _, change := range changes {
+		if err := encoder.Encode(change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reads up to limit changes the node applied, starting at offset
+// returns the offset to read next, tailing the log means reading
+// again from it
+func (c *Client) Changes(offset int64, limit int) ([]WatchEvent, int64, error) {
+	response, err := c.call(&protocol.Request{Op: "changes", Offset: offset, Limit: limit})
+	if err != nil {
+		return nil, offset, err
+	}
+
+	return response.Changes, response.Next, nil
+}
@@ -1,102 +1,366 @@
 package services
 
 import (
+	"strconv"
+	"sync"
+	"time"
+
+	"dist-kv/protocol"
 	u "dist-kv/utils"
-	"encoding/json"
-	"log"
-	"net"
 )
 
 type Client struct {
 	ServerIface string
 	TrackVersion bool
-	versions map[string]string
+	PoolSize int // connections kept open to the server
+	Timeout time.Duration // longest wait for a reply, DefaultTimeout when not set
+	Consistency string // level of every request on a mixed cluster
+	// causal context, every write this client has seen or made
+	clock u.VectorClock
+
+	mu sync.Mutex
+	pool *connPool
 }
 
 func (c *Client) Init(serverIface string, trackVersion bool) {
 	c.ServerIface = serverIface
 	c.TrackVersion = trackVersion
-	c.versions = make(map[string]string)
+	c.clock = u.VectorClock{}
+}
+
+// writes the value, the version is set when TrackVersion is
+func (c *Client) Write(key string, value string) (string, error) {
+	return c.WriteWithConsistency(key, value, c.Consistency)
+}
+
+// writes with the given consistency level on a mixed cluster
+func (c *Client) WriteWithConsistency(key, value, consistency string) (string, error) {
+	payload := &protocol.Request{
+		Op: "set",
+		Key: key,
+		Value: value,
+		Consistency: consistency,
+	}
+
+	// the write depends on everything this client has seen
+	if c.TrackVersion {
+		payload.Clock = c.Clock()
+	}
+
+	// blocking write!
+	response, err := c.call(payload)
+	if err != nil {
+		return "", err
+	}
+
+	if c.TrackVersion {
+		c.observe(response.Clock)
+		return strconv.FormatInt(response.Version, 10), nil
+	}
+
+	return "", nil
+}
+
+// writes a key that expires after ttl
+// every replica expires it at the same point of the order of writes
+// causal and quorum servers reject it as Unsupported
+func (c *Client) WriteWithTTL(key, value string, ttl time.Duration) (string, error) {
+	payload := &protocol.Request{
+		Op: "set",
+		Key: key,
+		Value: value,
+		TTL: ttl.Milliseconds(),
+	}
+	response, err := c.call(c.withConsistency(payload))
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(response.Version, 10), nil
+}
+
+// time the key has left, -1 if it does not expire
+// false if the key does not exist
+func (c *Client) TTL(key string) (time.Duration, bool, error) {
+	response, err := c.call(c.withConsistency(&protocol.Request{Op: "ttl", Key: key}))
+	if err != nil {
+		return 0, false, err
+	}
+
+	ms := response.TTL
+	if ms == -2 {
+		return 0, false, nil
+	} else if ms == -1 {
+		return -1, true, nil
+	}
+	return time.Duration(ms) * time.Millisecond, true, nil
 }
 
-func (c *Client) Write(key string, value string) string {
-	conn, err := net.Dial(u.Config.NetType, u.Config.NetAddr + ":" + c.ServerIface)
+// removes the expiry of the key, false if it had none
+func (c *Client) Persist(key string) (bool, error) {
+	response, err := c.call(c.withConsistency(&protocol.Request{Op: "persist", Key: key}))
 	if err != nil {
-		log.Fatal(err)
+		return false, err
+	}
+	return response.Persisted, nil
+}
+
+func (c *Client) Read(key string) (value, version string, err error) {
+	return c.ReadWithConsistency(key, c.Consistency)
+}
+
+// reads with the given consistency level on a mixed cluster
+func (c *Client) ReadWithConsistency(key, consistency string) (value, version string, err error) {
+	payload := &protocol.Request{
+		Op: "get",
+		Key: key,
+		Consistency: consistency,
+	}
+	if c.TrackVersion {
+		payload.Clock = c.Clock()
 	}
-	defer conn.Close()
 
-	payload := map[string]string {
-		"op": "set",
-		"key": key,
-		"value": value,
+	response, err := c.call(payload)
+	if err != nil {
+		return "", "", err
 	}
 
-	// for testing this injects random dependency!
 	if c.TrackVersion {
-		dependency := make(map[string]string)
-		for k, v := range c.versions {
-			dependency["key"] = k
-			dependency["version"] = v
-			break
-		}
-		rawObj, _ := json.Marshal(dependency)
-		payload["dependency"] = string(rawObj)
-	}
-	jsonPayload, _ := json.Marshal(payload)
-	conn.Write(jsonPayload)
+		c.observe(response.Clock)
+	}
+	return response.Value, strconv.FormatInt(response.Version, 10), nil
+}
 
-	// blocking write!
-	buffer := make([]byte, u.Config.PayloadSize)
-	size, _  := conn.Read(buffer)
+func (c *Client) Delete(key string) error {
+	return c.DeleteWithConsistency(key, c.Consistency)
+}
 
+// deletes with the given consistency level on a mixed cluster
+func (c *Client) DeleteWithConsistency(key, consistency string) error {
+	payload := &protocol.Request{
+		Op: "del",
+		Key: key,
+		Consistency: consistency,
+	}
+
+	// the delete depends on everything this client has seen
 	if c.TrackVersion {
-		response := make(map[string]string, 1)
-		json.Unmarshal(buffer[:size], &response)
-		c.versions[key] = response["version"]
-		return response["version"]
+		payload.Clock = c.Clock()
+	}
+
+	// blocking delete!
+	response, err := c.call(payload)
+	if err != nil {
+		return err
+	}
+
+	if c.TrackVersion {
+		c.observe(response.Clock)
+	}
+	return nil
+}
+
+// writes every key in one request, ordered as one unit on the servers
+func (c *Client) MultiSet(values map[string]string) error {
+	payload := &protocol.Request{Op: "mset", Values: values}
+
+	// blocking write!
+	_, err := c.call(c.withConsistency(payload))
+	return err
+}
+
+// reads every key in one request, missing keys are left out
+func (c *Client) MultiGet(keys []string) (map[string]string, error) {
+	payload := &protocol.Request{Op: "mget", Keys: keys}
+
+	response, err := c.call(c.withConsistency(payload))
+	if err != nil {
+		return nil, err
 	}
+	if response.Values == nil {
+		return map[string]string{}, nil
+	}
+	return response.Values, nil
+}
 
-	return ""
+// sets key to value only if it still holds the expected value
+// returns whether it was set and the value the key holds now
+// a missing key holds the empty value
+func (c *Client) CompareAndSet(key, expected, value string) (bool, string, error) {
+	response, err := c.compareAndSet(&protocol.Request{Key: key, Value: value, ExpectedValue: &expected})
+	if err != nil {
+		return false, "", err
+	}
+	return response.Swapped, response.Value, nil
 }
 
-func (c *Client) Read(key string) (value, version string) {
-	conn, err := net.Dial(u.Config.NetType, u.Config.NetAddr + ":" + c.ServerIface)
+// sets key to value only if it is still at the expected version
+// returns whether it was set and the version the key is at now
+// a missing key is at version 0
+func (c *Client) CompareVersionAndSet(key, version, value string) (bool, string, error) {
+	expected, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return false, "", protocol.Errorf(protocol.BadRequest, "malformed version %q", version)
+	}
+	response, err := c.compareAndSet(&protocol.Request{Key: key, Value: value, ExpectedVersion: &expected})
 	if err != nil {
-		log.Fatal(err)
+		return false, "", err
 	}
-	defer conn.Close()
+	return response.Swapped, strconv.FormatInt(response.Version, 10), nil
+}
+
+func (c *Client) compareAndSet(payload *protocol.Request) (*protocol.Reply, error) {
+	payload.Op = "cas"
+
+	// blocking compare and set!
+	return c.call(c.withConsistency(payload))
+}
 
-	payload := map[string]string {
-		"op": "get",
-		"key": key,
+// one page of the keys with start <= key < end in key order
+// empty end means no upper bound, limit <= 0 means the server default
+// the returned cursor fetches the next page, it is empty on the last one
+func (c *Client) Scan(start, end string, limit int, cursor string) ([]u.Entry, string, error) {
+	return c.scan(&protocol.Request{
+		Op: "scan",
+		Start: start,
+		End: end,
+		Limit: limit,
+		Cursor: cursor,
+	})
+}
+
+// one page of the keys starting with the prefix, paged like Scan
+func (c *Client) ScanPrefix(prefix string, limit int, cursor string) ([]u.Entry, string, error) {
+	return c.scan(&protocol.Request{
+		Op: "scan",
+		Prefix: prefix,
+		Limit: limit,
+		Cursor: cursor,
+	})
+}
+
+func (c *Client) scan(payload *protocol.Request) ([]u.Entry, string, error) {
+	if c.TrackVersion {
+		payload.Clock = c.Clock()
+	}
+
+	response, err := c.call(c.withConsistency(payload))
+	if err != nil {
+		return nil, "", err
 	}
 	if c.TrackVersion {
-		minVersion, ok := c.versions[key]
-		if ok {
-			payload["minVersion"] = minVersion
-		} else {
-			payload["minVersion"] = "0"
-		}
+		c.observe(response.Clock)
+	}
+	return response.Entries, response.Cursor, nil
+}
+
+// result of a causal read
+type CausalRead struct {
+	Value string
+	Version string
+	Clock u.VectorClock // writes the value depends on
+	Concurrent bool // the value won over a concurrent write
+}
+
+// reads from a causal server and reports concurrent writes to the key
+func (c *Client) ReadCausal(key string) (CausalRead, error) {
+	payload := &protocol.Request{
+		Op: "get",
+		Key: key,
+		Clock: c.Clock(),
+		Consistency: CausalLevel,
 	}
 
-	jsonPayload, _ := json.Marshal(payload)
-	conn.Write(jsonPayload)
+	response, err := c.call(payload)
+	if err != nil {
+		return CausalRead{}, err
+	}
+	c.observe(response.Clock)
+
+	clock := response.Clock
+	if clock == nil {
+		clock = u.VectorClock{}
+	}
+	return CausalRead{
+		Value: response.Value,
+		Version: strconv.FormatInt(response.Version, 10),
+		Clock: clock,
+		Concurrent: response.Concurrent,
+	}, nil
+}
+
+// a copy of the causal context of the client
+func (c *Client) Clock() u.VectorClock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clock.Copy()
+}
 
-	buffer := make([]byte, u.Config.PayloadSize)
-	size, _  := conn.Read(buffer)
+// closes every pooled connection
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	response := make(map[string]string, 1)
-	json.Unmarshal(buffer[:size], &response)
+	if c.pool != nil {
+		c.pool.close()
+		c.pool = nil
+	}
+}
 
-	value, ok := response["value"]
-	version, vOk := response["version"]
-	if ok && vOk {
-		c.versions[key] = version
-		return value, version
-	} else if ok {
-		return value, ""
+// sends one request over the pooled connections and waits for its response
+// every error is a *protocol.Error, failures of the reply are returned as sent
+func (c *Client) call(payload *protocol.Request) (*protocol.Reply, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	response, err := c.connPool().call(payload, timeout)
+	if err != nil {
+		return nil, connError(err)
 	}
+	if response.Error != nil {
+		return response, response.Error
+	}
+	return response, nil
+}
 
-	return "", ""
-}
\ No newline at end of file
+// error of a request that got no reply
+// the server could not be reached, dropped the connection or did not answer in time
+func connError(err error) *protocol.Error {
+	if err == u.ErrFrameTooLarge {
+		return protocol.Wrap(protocol.TooLarge, err)
+	}
+	if err == errCallTimeout {
+		return protocol.Wrap(protocol.Timeout, err)
+	}
+	return protocol.Wrap(protocol.Unavailable, err)
+}
+
+// the pooled connections, opened on first use
+func (c *Client) connPool() *connPool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pool == nil {
+		c.pool = newConnPool(c.ServerIface, c.PoolSize)
+	}
+	return c.pool
+}
+
+// adds the consistency level of the client to a request
+func (c *Client) withConsistency(payload *protocol.Request) *protocol.Request {
+	if c.Consistency != "" {
+		payload.Consistency = c.Consistency
+	}
+	return payload
+}
+
+// merges a clock returned by the server into the causal context
+func (c *Client) observe(clock u.VectorClock) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.clock == nil {
+		c.clock = u.VectorClock{}
+	}
+	c.clock.Merge(clock)
+}
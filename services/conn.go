@@ -0,0 +1,313 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"dist-kv/protocol"
+	u "dist-kv/utils"
+)
+
+// serves a client request and returns the reply
+type requestHandler func(*protocol.Request) *protocol.Reply
+
+// handles a message from another server
+type peerHandler func(*protocol.Peer)
+
+// ops only some modes serve
+// cas and transactions need every replica to decide them at the same
+// point of one order of operations, only the linearizable mode has one
+// expiry needs a timestamp every replica agrees on for the write
+// batches are ordered as one unit in the priority queues
+var orderedOnly = map[string]bool{
+	"cas": true, "begin": true, "txget": true, "txn": true,
+	"ttl": true, "persist": true, "mget": true, "mset": true,
+}
+
+// error for a request with an op the mode does not serve
+func clientError(op string) *protocol.Error {
+	if orderedOnly[op] {
+		return protocol.Errorf(protocol.Unsupported, "%s is not supported in this consistency mode", op)
+	}
+	return protocol.Errorf(protocol.BadRequest, "Unknown op: %s", op)
+}
+
+// a reply carrying only the error
+func failed(err *protocol.Error) *protocol.Reply {
+	return &protocol.Reply{Error: err}
+}
+
+// error for a failed store operation
+// a snapshot past the retained versions is a conflict the client can retry
+func storeError(err error) *protocol.Error {
+	if err == u.ErrSnapshotTooOld {
+		return protocol.Wrap(protocol.Conflict, err)
+	}
+	return protocol.Wrap(protocol.Internal, err)
+}
+
+// error for a request the other replicas did not answer in time
+// Unavailable if a replica can not be reached, Timeout if they are just slow
+func replicaError(bus Bus, replicas []string, err error) *protocol.Error {
+	for _, to := range replicas {
+		if linkErr := bus.LastError(to); linkErr != nil {
+			return protocol.Errorf(protocol.Unavailable, "server %s is unreachable: %v", to, linkErr)
+		}
+	}
+	return protocol.Wrap(protocol.Timeout, err)
+}
+
+// reads one framed JSON message from the connection into v
+func readMessage(conn net.Conn, v any) error {
+	payload, err := u.ReadFrame(conn)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, v)
+}
+
+// writes the message as a single frame
+func writeMessage(conn net.Conn, v any) error {
+	res, _ := json.Marshal(v)
+	return u.WriteFrame(conn, res)
+}
+
+// reports a request that could not be read and drops the connection
+// after a bad frame the stream can not be resynced
+func rejectConn(conn net.Conn, err error) {
+	defer conn.Close()
+	if err == u.ErrFrameTooLarge {
+		writeMessage(conn, failed(protocol.Wrap(protocol.TooLarge, err)))
+	}
+	log.Printf("Rejected request from %s: %v\n", conn.RemoteAddr(), err)
+}
+
+// listeners and transports of the running servers keyed by server port
+var runningMu sync.Mutex
+var running = map[string][]io.Closer{}
+
+func track(owner string, c io.Closer) {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	running[owner] = append(running[owner], c)
+}
+
+// stops the server owning the given server port
+func KillServer(serverIface string) {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	for _, c := range running[serverIface] {
+		c.Close()
+	}
+	delete(running, serverIface)
+}
+
+func closeAll() {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	for owner, closers := range running {
+		for _, c := range closers {
+			c.Close()
+		}
+		delete(running, owner)
+	}
+}
+
+// listens on iface on behalf of the server owning the given server port
+func listen(iface, owner string) (net.Listener, error) {
+	listener, err := net.Listen(u.Config.NetType, u.Config.NetAddr+":"+iface)
+	if err != nil {
+		return nil, err
+	}
+	track(owner, listener)
+	return listener, nil
+}
+
+// accepts client connections until the listener is closed
+// open connections are dropped along with the listener
+// watch requests stream the changes published to the hub
+func serveClients(listener net.Listener, handle requestHandler, hub *watchHub) error {
+	conns := newConnSet()
+	defer conns.closeAll()
+
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		conns.add(conn)
+		go func() {
+			serveClient(conn, handle, hub)
+			conns.remove(conn)
+		}()
+	}
+}
+
+// accepts peer connections until the listener is closed
+// messages on one connection are handled one at a time, in order
+func servePeers(listener net.Listener, handle peerHandler) {
+	servePeerFrames(listener, func(payload []byte) {
+		message := &protocol.Peer{}
+		if err := json.Unmarshal(payload, message); err != nil {
+			log.Printf("Dropping malformed peer message: %v\n", err)
+			return
+		}
+		handle(message)
+	})
+}
+
+// like servePeers but hands over the raw frames
+func servePeerFrames(listener net.Listener, handle func([]byte)) {
+	conns := newConnSet()
+	defer conns.closeAll()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conns.add(conn)
+
+		go func(conn net.Conn) {
+			defer conns.remove(conn)
+			defer conn.Close()
+			for {
+				payload, err := u.ReadFrame(conn)
+				if err == io.EOF {
+					return
+				} else if err != nil {
+					log.Printf("Dropping peer connection from %s: %v\n", conn.RemoteAddr(), err)
+					return
+				}
+				handle(payload)
+			}
+		}(conn)
+	}
+}
+
+// serves every request arriving on a client connection until it is closed
+// responses carry the request's "reqId" and may be written out of order
+// a watch answers with a stream of messages under its reqId until an
+// unwatch naming it arrives or the connection closes
+// changes reads the change log of the node
+func serveClient(conn net.Conn, handle requestHandler, hub *watchHub) {
+	var writeMu sync.Mutex
+	defer conn.Close()
+
+	send := func(reqId string, reply *protocol.Reply) {
+		reply.ReqId = reqId
+		writeMu.Lock()
+		err := writeMessage(conn, reply)
+		if err == u.ErrFrameTooLarge {
+			// the frame was refused before anything was written
+			writeMessage(conn, &protocol.Reply{ReqId: reqId, Error: protocol.Wrap(protocol.TooLarge, err), Done: reply.Done})
+		}
+		writeMu.Unlock()
+	}
+
+	// cancels of the open watches by reqId
+	var watchMu sync.Mutex
+	watches := map[string]chan struct{}{}
+	defer func() {
+		watchMu.Lock()
+		defer watchMu.Unlock()
+		for reqId, cancel := range watches {
+			close(cancel)
+			delete(watches, reqId)
+		}
+	}()
+
+	for {
+		message := &protocol.Request{}
+		err := readMessage(conn, message)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			rejectConn(conn, err)
+			return
+		}
+		reqId := message.ReqId
+		message.Op = strings.ToLower(message.Op)
+
+		switch message.Op {
+		case "watch":
+			if hub == nil {
+				send(reqId, &protocol.Reply{Error: protocol.Errorf(protocol.Unsupported, "watch is not supported by this server"), Done: true})
+				continue
+			}
+			cancel := make(chan struct{})
+			watchMu.Lock()
+			watches[reqId] = cancel
+			watchMu.Unlock()
+
+			go func() {
+				serveWatch(hub, message, func(reply *protocol.Reply) { send(reqId, reply) }, cancel)
+				watchMu.Lock()
+				if watches[reqId] == cancel {
+					delete(watches, reqId)
+				}
+				watchMu.Unlock()
+			}()
+
+		case "unwatch":
+			watchMu.Lock()
+			cancel, ok := watches[message.Watch]
+			if ok {
+				close(cancel)
+				delete(watches, message.Watch)
+			}
+			watchMu.Unlock()
+			send(reqId, &protocol.Reply{Unwatched: ok})
+
+		case "changes":
+			if hub == nil {
+				send(reqId, failed(protocol.Errorf(protocol.Unsupported, "changes are not supported by this server")))
+				continue
+			}
+			send(reqId, serveChanges(hub, message))
+
+		default:
+			go func(message *protocol.Request) {
+				send(reqId, handle(message))
+			}(message)
+		}
+	}
+}
+
+// the open connections accepted by one listener
+type connSet struct {
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+}
+
+func newConnSet() *connSet {
+	return &connSet{conns: make(map[net.Conn]bool)}
+}
+
+func (cs *connSet) add(conn net.Conn) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.conns[conn] = true
+}
+
+func (cs *connSet) remove(conn net.Conn) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.conns, conn)
+}
+
+func (cs *connSet) closeAll() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for conn := range cs.conns {
+		conn.Close()
+	}
+	cs.conns = map[net.Conn]bool{}
+}
@@ -5,130 +5,320 @@ import (
 	"encoding/json"
 	"log"
 	"math/rand"
-	"net"
-	"strconv"
 	"strings"
 	"sync"
-	"time"
 
+	"dist-kv/protocol"
 	u "dist-kv/utils"
-
-	"github.com/redis/go-redis/v9"
 )
 
 /*
 	- Eventually consistent
 	- Most practical and loose consistency gaurantees!
+	- Last writer wins by hybrid logical clock timestamp
+	- Deletes leave a tombstone until every replica has seen them
 */
 func StartEventualServer(clientIface, serverIface, kvStoreIface string) error {
-	// config accessor
-	cfg := u.Config
 	ctx := context.Background()
 
-	kvStore, err := u.StartRedisClient(ctx, kvStoreIface)
+	kvStore, err := u.StartStore(ctx, kvStoreIface)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// changes applied to the store are streamed to watchers
+	hub := newWatchHub()
+	kvStore = hub.watch(kvStore)
 
 	// fmt.Printf("Server listeneing on ports: %s | %s\n", clientIface, serverIface)
-	listener, _ := net.Listen(cfg.NetType, cfg.NetAddr + ":" + clientIface)
-	intListener, _ := net.Listen(cfg.NetType, cfg.NetAddr + ":" + serverIface) // internal listener
+	listener, err := listen(clientIface, serverIface)
+	if err != nil {
+		return err
+	}
+	intListener, err := listen(serverIface, serverIface) // internal listener
+	if err != nil {
+		return err
+	}
+	transport := NewTransport(serverIface)
+
+	handleRequest, handlePeer := newEventual(clientIface, serverIface, kvStore, transport, realClock{}, newRand())
+	go servePeers(intListener, handlePeer)
+
+	// handle connections until the server is killed
+	return serveClients(listener, handleRequest, hub)
+}
+
+// handlers of the eventual protocol over the given store, message bus and clock
+func newEventual(clientIface, serverIface string, kvStore u.Store, bus Bus, clock Clock, r *rand.Rand) (requestHandler, peerHandler) {
+	// config accessor
+	cfg := u.Config
+	// ids of the messages this server sends
+	nextId := newIds(serverIface, r)
 
 	var mu sync.Mutex
-	connQ := make(chan net.Conn, 1000)
-
-	// register connection handler for server-to-server broadcasts 
-	go func() {
-		for {
-			conn, _ := intListener.Accept()
-
-			go func(conn net.Conn) {
-				defer conn.Close()
-				buffer := make([]byte, cfg.PayloadSize)
-				size, _ := conn.Read(buffer)
-
-				message := map[string]string{}
-				json.Unmarshal(buffer[:size], &message)
-				message["op"] = strings.ToLower(message["op"])
-
-				// only write messages are broadcasted
-				if message["op"] == "set" {
-					mu.Lock()
-					kvStore.Set(ctx, message["key"], message["value"], 0)
-					mu.Unlock()
-				}
-			}(conn)
+	// orders concurrent writes, the latest write to a key wins everywhere
+	hlc := newHLC(clock)
+	// winning write of every key, deleted keys keep theirs as a tombstone
+	stamps := map[string]eventualStamp{}
+	// deletes and the replicas that have seen them, by message id
+	tombstones := map[string]*tombstone{}
+	// keys expire at the timestamp of their write plus the ttl, every
+	// replica applying the write computes the same time
+	expiry := u.NewExpirations()
+
+	// applies a write unless a later one was already applied
+	// callers hold mu
+	apply := func(message *protocol.Peer) {
+		ts := message.Timestamp
+		req := &message.Request
+		stamp := eventualStamp{ts: ts, origin: message.Origin, id: message.Id}
+		if current, ok := stamps[req.Key]; ok && !current.before(stamp) {
+			return
+		}
+
+		// a mixed server skips a write a later one of another level overtook
+		if req.Op == "del" {
+			applyAt(kvStore, ts, message.Origin, u.Write{Key: req.Key, Delete: true})
+			expiry.Clear(req.Key)
+			stamp.deleted = true
+		} else if applied, _ := applyAt(kvStore, ts, message.Origin, u.Write{Key: req.Key, Value: req.Value}); applied {
+			if req.TTL > 0 {
+				expiry.Set(req.Key, ts.Wall + req.TTL)
+			} else {
+				expiry.Clear(req.Key)
+			}
+		}
+		stamps[req.Key] = stamp
+	}
+
+	// deletes the keys expired at now
+	// the stamp stays, so an older write arriving late can not bring a key back
+	// callers hold mu
+	expire := func(now int64) {
+		forExpired(expiry, now, func(key string, at u.Timestamp) {
+			applyAt(kvStore, at, "", u.Write{Key: key, Delete: true})
+		})
+	}
+
+	// drops tombstones every other replica has acknowledged
+	// FIFO peer links deliver any write a replica sent before its ack
+	// ahead of the ack, so no older write can arrive after this point
+	// callers hold mu
+	collect := func() {
+		for id, t := range tombstones {
+			if len(t.acks) < cfg.NumServers - 1 {
+				continue
+			}
+			if stamp, ok := stamps[t.key]; ok && stamp.deleted && stamp.id == id {
+				delete(stamps, t.key)
+			}
+			delete(tombstones, id)
+		}
+	}
+
+	// tells every other replica this one has seen the delete
+	ack := func(message *protocol.Peer) {
+		ackMsg := *message
+		ackMsg.Ack = true
+		ackMsg.From = serverIface
+		jsonMsg, _ := json.Marshal(ackMsg)
+		if err := bus.Broadcast(jsonMsg, false); err != nil {
+			log.Printf("Broadcast from %s failed: %v\n", serverIface, err)
+		}
+	}
+
+	// the tombstone of a delete, created before it is acknowledged
+	// callers hold mu
+	track := func(message *protocol.Peer) *tombstone {
+		t, ok := tombstones[message.Id]
+		if !ok {
+			t = &tombstone{key: message.Request.Key, acks: map[string]bool{}}
+			tombstones[message.Id] = t
+		}
+		return t
+	}
+
+	// handler for server-to-server broadcasts
+	// messages from one peer are handled in the order they were sent
+	handlePeer := func(message *protocol.Peer) {
+		op := strings.ToLower(message.Request.Op)
+		message.Request.Op = op
+
+		// every received message moves the clock past its timestamp
+		hlc.Update(message.Timestamp)
+
+		if message.Ack {
+			mu.Lock()
+			// a duplicated ack counts once
+			track(message).acks[message.From] = true
+			collect()
+			mu.Unlock()
+			return
 		}
-	}()
-
-	// connection handler for client-to-server messages
-	go func() {
-		for conn := range connQ {
-			// handle connection here
-			buffer := make([]byte, cfg.PayloadSize)
-			size, _ := conn.Read(buffer)
-
-			// format {op: 'set', key: key, value: value}
-			// format {op: 'get', key: key}
-			message := make(map[string]string)
-			json.Unmarshal(buffer[:size], &message)
-
-			message["op"] = strings.ToLower(message["op"])
-			// add unique message id
-			message["id"] = strconv.Itoa(rand.Int())
-			// add timestamp to the request
-			timestamp := time.Now().UnixMilli()
-			message["timestamp"] = strconv.FormatInt(timestamp, 10)
-
-			if message["op"] != "set" && message["op"] != "get" {
-				message["error"] = "Client Error!"
+
+		// only write messages are broadcasted
+		if op == "set" || op == "del" {
+			mu.Lock()
+			apply(message)
+			if op == "del" {
+				track(message)
+			}
+			mu.Unlock()
+
+			if op == "del" {
+				ack(message)
+			}
+		}
+	}
+
+	// handler for client-to-server requests
+	// requests sharing a connection are served concurrently
+	handleRequest := func(message *protocol.Request) *protocol.Reply {
+		// format {op: 'set', key: key, value: value, ttl: milliseconds}
+		// format {op: 'get', key: key}
+		// format {op: 'del', key: key}
+		// format {op: 'ttl', key: key}
+		// format {op: 'persist', key: key}
+		// format {op: 'scan', start: key, end: key, prefix: prefix, limit: n, cursor: cursor}
+		message.Op = strings.ToLower(message.Op)
+		// add timestamp to the request
+		timestamp := clock.Now().UnixMilli()
+
+		reply := &protocol.Reply{}
+		write := *message
+		if message.Op == "persist" {
+			// a persist rewrites the current value without a ttl, so replicas that
+			// already expired the key get it back
+			mu.Lock()
+			expire(hlc.Now().Wall)
+			entry, err := kvStore.Get(message.Key)
+			_, expires := expiry.Get(message.Key)
+			mu.Unlock()
+
+			reply.Persisted = err == nil && expires
+			if !reply.Persisted {
+				return reply
+			}
+			write.Op = "set"
+			write.Value = entry.Value
+		}
+
+		if message.Op == "ttl" {
+			// Local Read
+			mu.Lock()
+			now := hlc.Now().Wall
+			expire(now)
+			reply.TTL = remainingTTL(kvStore, expiry, message.Key, now)
+			mu.Unlock()
+			log.Printf("%d Ttl of %s is %d at server %s\n", timestamp, message.Key, reply.TTL, clientIface)
+		} else if write.Op == "set" || write.Op == "del" {
+			// Local Write!
+			if message.Op == "set" {
+				log.Printf("%d Start : Write %s = %s at server %s\n", 
+					timestamp, message.Key, message.Value, clientIface)
+			} else if message.Op == "del" {
+				log.Printf("%d Start : Delete %s at server %s\n",
+					timestamp, message.Key, clientIface)
 			} else {
-				// Local Write!
-				if message["op"] == "set" {
-					log.Printf("%d Start : Write %s = %s at server %s\n", 
-						timestamp, message["key"], message["value"], clientIface)
-
-					mu.Lock()
-					kvStore.Set(ctx, message["key"], message["value"], 0)
-					mu.Unlock()
-
-					jsonMsg, _ := json.Marshal(message)
-
-					BroadcastMsg(jsonMsg, serverIface, false, 5)
-
-					log.Printf("%d End   : Write %s = %s at server %s\n",
-						time.Now().UnixMilli(), message["key"], message["value"], clientIface)
-
-				} else if message["op"] == "get" {
-					// Local Read
-					log.Printf("%d Start : Read %s at server %s\n", 
-						timestamp, message["key"], clientIface)
-
-					mu.Lock()
-					val, err := kvStore.Get(ctx, message["key"]).Result()
-					mu.Unlock()
-					if err == redis.Nil {
-						message["value"] = "nil"
-					} else {
-						message["value"] = val
-					}
-
-					log.Printf("%d End   : Read %s = %s at server %s\n",
-						time.Now().UnixMilli(), message["key"], message["value"], clientIface)
-				}
-	
-				message["errors"] = ""
+				log.Printf("%d Start : Persist %s at server %s\n",
+					timestamp, message.Key, clientIface)
+			}
+
+			broadcast := &protocol.Peer{
+				Request: write,
+				// add unique message id
+				Id: nextId(),
+				Origin: serverIface,
+				Timestamp: hlc.Now(),
 			}
 
-			res, _ := json.Marshal(message)
-			conn.Write(res)
-			conn.Close()
+			mu.Lock()
+			apply(broadcast)
+			if write.Op == "del" {
+				track(broadcast)
+			}
+			mu.Unlock()
+
+			jsonMsg, _ := json.Marshal(broadcast)
+
+			if err := bus.Broadcast(jsonMsg, false); err != nil {
+				// applied here, the other replicas may never see it
+				log.Printf("Broadcast from %s failed: %v\n", serverIface, err)
+				return failed(protocol.Wrap(protocol.Unavailable, err))
+			}
+			if write.Op == "del" {
+				ack(broadcast)
+			}
+
+			if message.Op == "set" {
+				log.Printf("%d End   : Write %s = %s at server %s\n",
+					clock.Now().UnixMilli(), message.Key, message.Value, clientIface)
+			} else if message.Op == "del" {
+				log.Printf("%d End   : Delete %s at server %s\n",
+					clock.Now().UnixMilli(), message.Key, clientIface)
+			} else {
+				log.Printf("%d End   : Persist %s at server %s\n",
+					clock.Now().UnixMilli(), message.Key, clientIface)
+			}
+
+		} else if message.Op == "scan" {
+			// Local Scan
+			log.Printf("%d Start : Scan [%s, %s) at server %s\n",
+				timestamp, message.Start, message.End, clientIface)
+
+			mu.Lock()
+			expire(hlc.Now().Wall)
+			reply = serveScan(kvStore, message)
+			mu.Unlock()
+
+			log.Printf("%d End   : Scan [%s, %s) cursor %s at server %s\n",
+				clock.Now().UnixMilli(), message.Start, message.End, reply.Cursor, clientIface)
+
+		} else if message.Op == "get" {
+			// Local Read
+			log.Printf("%d Start : Read %s at server %s\n", 
+				timestamp, message.Key, clientIface)
+
+			mu.Lock()
+			expire(hlc.Now().Wall)
+			entry, err := kvStore.Get(message.Key)
+			mu.Unlock()
+			if err == u.ErrNotFound {
+				reply.Value = "nil"
+			} else {
+				reply.Value = entry.Value
+				reply.Version = entry.Version
+			}
+
+			log.Printf("%d End   : Read %s = %s at server %s\n",
+				clock.Now().UnixMilli(), message.Key, reply.Value, clientIface)
+		} else {
+			return failed(clientError(message.Op))
 		}
-	}()
 
-	// handle connections
-	for {
-		conn, _ := listener.Accept()
-		connQ <- conn
+		return reply
+	}
+
+	return handleRequest, handlePeer
+}
+
+// the write a key holds on an eventual replica
+type eventualStamp struct {
+	ts      u.Timestamp
+	origin  string // breaks ties between equal timestamps
+	id      string
+	deleted bool // the key was deleted, the stamp is its tombstone
+}
+
+func (s eventualStamp) before(other eventualStamp) bool {
+	if s.ts != other.ts {
+		return s.ts.Less(other.ts)
 	}
-}
\ No newline at end of file
+	return s.origin < other.origin
+}
+
+// a delete waiting for every replica to acknowledge it
+type tombstone struct {
+	key   string
+	acks  map[string]bool // replicas other than this one that have seen it, by port
+	clock u.VectorClock     // merged applied clocks of the acks, causal only
+}
@@ -0,0 +1,141 @@
+package services
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/*
+	Network faults injected into every transport, tests drive them
+	- a partition cuts the links between groups of servers, messages
+	  over a cut link wait in the queue of the peer until it is healed,
+	  like a connection that keeps retrying
+	- dropped messages are lost for good, duplicated ones are delivered twice
+	- reordered messages are held back for a random time, later messages
+	  to the same peer overtake them
+	- messages a server sends to itself are never faulted
+*/
+type networkFaults struct {
+	mu        sync.Mutex
+	group     map[string]int // partition group of each listed server port
+	drop      float64        // percent of messages dropped
+	duplicate float64        // percent of messages delivered twice
+	reorder   float64        // percent of messages held back
+	window    time.Duration  // longest a message is held back
+	rand      *rand.Rand
+	// closed and replaced whenever the partition changes
+	changed chan struct{}
+}
+
+var faults = &networkFaults{
+	group:   map[string]int{},
+	rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	changed: make(chan struct{}),
+}
+
+// cuts the network between the groups of server ports
+// servers in no group still reach every server
+func Partition(groups ...[]string) {
+	faults.mu.Lock()
+	defer faults.mu.Unlock()
+
+	faults.group = map[string]int{}
+	for i, group := range groups {
+		for _, port := range group {
+			faults.group[port] = i
+		}
+	}
+	faults.notify()
+}
+
+// drops the given percent of the messages between servers
+func DropMessages(percent float64) {
+	faults.mu.Lock()
+	defer faults.mu.Unlock()
+	faults.drop = percent
+}
+
+// delivers the given percent of the messages between servers twice
+func DuplicateMessages(percent float64) {
+	faults.mu.Lock()
+	defer faults.mu.Unlock()
+	faults.duplicate = percent
+}
+
+// holds back the given percent of the messages between servers for up to window
+func ReorderMessages(percent float64, window time.Duration) {
+	faults.mu.Lock()
+	defer faults.mu.Unlock()
+	faults.reorder = percent
+	faults.window = window
+}
+
+// removes every fault, messages held by the partition are delivered
+func Heal() {
+	faults.mu.Lock()
+	defer faults.mu.Unlock()
+
+	faults.group = map[string]int{}
+	faults.drop = 0
+	faults.duplicate = 0
+	faults.reorder = 0
+	faults.window = 0
+	faults.notify()
+}
+
+// wakes up the links waiting for the partition to change
+// callers hold f.mu
+func (f *networkFaults) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// callers hold f.mu
+func (f *networkFaults) cut(from, to string) bool {
+	a, okA := f.group[from]
+	b, okB := f.group[to]
+	return okA && okB && a != b
+}
+
+// blocks while the link is cut, false if done was closed meanwhile
+func (f *networkFaults) waitLink(from, to string, done chan struct{}) bool {
+	for {
+		f.mu.Lock()
+		cut := f.cut(from, to)
+		changed := f.changed
+		f.mu.Unlock()
+		if !cut {
+			return true
+		}
+
+		select {
+		case <-done:
+			return false
+		case <-changed:
+		}
+	}
+}
+
+// how many copies of a message to deliver, and how long to hold them back
+func (f *networkFaults) fate(from, to string) (int, time.Duration) {
+	if from == to {
+		return 1, 0
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.rand.Float64()*100 < f.drop {
+		return 0, 0
+	}
+	copies := 1
+	if f.rand.Float64()*100 < f.duplicate {
+		copies = 2
+	}
+	var hold time.Duration
+	if f.window > 0 && f.rand.Float64()*100 < f.reorder {
+		hold = time.Duration(f.rand.Int63n(int64(f.window)))
+	}
+	return copies, hold
+}
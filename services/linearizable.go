@@ -4,232 +4,482 @@ import (
 	"container/heap"
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"log"
-	"math"
 	"math/rand"
-	"net"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"dist-kv/protocol"
 	u "dist-kv/utils"
 )
 
+// longest a request waits for every replica to acknowledge it
+const orderTimeout = 5 * time.Second
+
+var errOrderTimeout = errors.New("timed out waiting for every replica, the request may still take effect")
+
 /*
 	- Total order broadcast for both reads and writes
-	- Ordering is based on wall clock time -> Linearizability
-	- Local machine time is used as global wall clock time
+	- Ordering is based on hybrid logical clocks -> Linearizability
+	- An operation is stamped after every operation that completed before it,
+	  even when the clocks of the machines are skewed
 */
 func StartLinearizableServer(clientIface, serverIface, kvStoreIface string) error {
-	// config accessor
-	cfg := u.Config
 	ctx := context.Background()
 
-	kvStore, err := u.StartRedisClient(ctx, kvStoreIface)
+	kvStore, err := u.StartStore(ctx, kvStoreIface)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// changes applied to the store are streamed to watchers
+	hub := newWatchHub()
+	kvStore = hub.watch(kvStore)
 
 	// fmt.Printf("Server listeneing on ports: %s | %s\n", clientIface, serverIface)
-	listener, _ := net.Listen(cfg.NetType, cfg.NetAddr + ":" + clientIface)
-	intListener, _ := net.Listen(cfg.NetType, cfg.NetAddr + ":" + serverIface) // internal listener
+	listener, err := listen(clientIface, serverIface)
+	if err != nil {
+		return err
+	}
+	intListener, err := listen(serverIface, serverIface) // internal listener
+	if err != nil {
+		return err
+	}
+	transport := NewTransport(serverIface)
+
+	handleRequest, handlePeer := newLinearizable(clientIface, serverIface, kvStore, transport, realClock{}, newRand())
+	go servePeers(intListener, handlePeer)
+
+	// handle connections until the server is killed
+	return serveClients(listener, handleRequest, hub)
+}
+
+// handlers of the linearizable protocol over the given store, message bus and clock
+func newLinearizable(clientIface, serverIface string, kvStore u.Store, bus Bus, clock Clock, r *rand.Rand) (requestHandler, peerHandler) {
+	// config accessor
+	cfg := u.Config
+	// ids of the messages this server sends
+	nextId := newIds(serverIface, r)
 
 	var mu sync.Mutex
 	// tracks message id and ack count
 	acks := map[string]int{}
-	connQ := make(chan net.Conn, 1000)
-	pq := make(u.PriorityQueue, 0)
+	// replies to the conditional writes of this server, by message id
+	// only requests still waiting for their reply get one
+	outcomes := map[string]*protocol.Reply{}
+	waiting := map[string]bool{}
+	// every write is a commit, so transactions read consistent snapshots
+	mvcc := mvccOf(kvStore)
+	// keys expire at the ordering timestamp of their write plus the ttl
+	expiry := u.NewExpirations()
+	hlc := newHLC(clock)
+	pq := make(u.PriorityQueue[*protocol.Peer], 0)
 	heap.Init(&pq)
 
-	// register connection handler for server-to-server broadcasts 
-	go func() {
-		for {
-			conn, _ := intListener.Accept()
-			buffer := make([]byte, cfg.PayloadSize)
-			size, _ := conn.Read(buffer)
-
-			message := map[string]string{}
-			json.Unmarshal(buffer[:size], &message)
-			message["op"] = strings.ToLower(message["op"])
-
-			_, isAck := message["ack"]
-			// fmt.Printf("At %s received {%s: %s}\n", serverIface, message["op"], message["totalOrderTimestamp"])
-			// message is acknowledgement
-			if isAck {
-				mu.Lock()
-				_, ok := acks[message["id"]]
-				if ok {
-					acks[message["id"]]++
-				} else {
-					acks[message["id"]] = 1
-				}
-
-				// whenever we got an ack, we check whether the message is deliverable
-				for pq.Len() > 0 {
-					head := heap.Pop(&pq).(*u.Item)
-					// received all the acks for the head
-					if acks[head.Message["id"]] == cfg.NumServers {
-						// fmt.Printf("Processing top of the heap {%s: %s} at %s\n", head.Message["op"], head.Message["totalOrderTimestamp"], serverIface)
-						if head.Message["op"] == "set" {
-							// write the message
-							kvStore.Set(ctx, head.Message["key"], head.Message["value"], 0)
-						} else {
-							kvStore.Get(ctx, head.Message["key"]).Result()
-						} // read the message
-
-						// assuming we don't get acks after we receive all acks
-						acks[head.Message["id"]] = -1
-						// fmt.Printf("%v\n", acks)
-						// fmt.Printf("PQ len %d\n", pq.Len())
-					} else {
-						heap.Push(&pq, head)
-						break
-					}
-				}
+	// applies a message delivered at the given point of the total order
+	// callers hold mu
+	deliver := func(message *protocol.Peer) {
+		ts := message.Timestamp
+		req := &message.Request
+		// keys expired before this point are deleted before it on every replica
+		forExpired(expiry, ts.Wall, func(key string, at u.Timestamp) {
+			commitAt(kvStore, mvcc, at, "", []u.Write{{Key: key, Delete: true}})
+		})
+		// commits writes ordered at this point, a mixed server leaves out
+		// the ones a later write of another level overtook
+		commit := func(writes []u.Write) (int64, []u.Write, error) {
+			return commitAt(kvStore, mvcc, ts, message.Origin, writes)
+		}
 
-				mu.Unlock()
-				// spawn a go routine if all acks are all received
-
-			} else if message["op"] == "set" || message["op"] == "get" {
-				// Generating total order based on process id
-				// strips the unix timestamp for testing
-				totOrderTimestamp := message["totalOrderTimestamp"]
-				timestamp, _ := strconv.ParseFloat(totOrderTimestamp, 64)
-
-				mu.Lock()
-				heap.Push(&pq, &u.Item{
-					Message: message,
-					Priority: timestamp,
-				})
-				top := heap.Pop(&pq).(*u.Item)
-				// fmt.Printf("Top at PQ on %s is {%s: %f}\n", serverIface, top.Message["op"], top.Priority)
-				heap.Push(&pq, top)
-				mu.Unlock()
-
-				// serialize message
-				message["ack"] = "ok"
-				jsonMsg, _ := json.Marshal(message)
-
-				// broadcast ack to all the other servers including itself!
-				BroadcastMsg(jsonMsg, serverIface, true, 5)
+		var outcome *protocol.Reply
+		switch req.Op {
+		case "set":
+			// write the message
+			_, applied, _ := commit([]u.Write{{Key: req.Key, Value: req.Value}})
+			if len(applied) == 0 {
+				break
 			}
-			conn.Close()
+			if req.TTL > 0 {
+				expiry.Set(req.Key, ts.Wall + req.TTL)
+			} else {
+				expiry.Clear(req.Key)
+			}
+		case "del":
+			_, applied, _ := commit([]u.Write{{Key: req.Key, Delete: true}})
+			clearExpiry(expiry, applied)
+		case "mset":
+			// one commit, readers see all of the keys or none
+			writes, _ := parseValues(req)
+			_, applied, _ := commit(writes)
+			clearExpiry(expiry, applied)
+		case "cas":
+			// every replica decides at the same point of the order
+			var applied []u.Write
+			outcome, applied = compareAndSet(kvStore, commit, req)
+			clearExpiry(expiry, applied)
+		case "txn":
+			var applied []u.Write
+			outcome, applied = commitTxn(mvcc, commit, req)
+			clearExpiry(expiry, applied)
+		case "persist":
+			outcome = &protocol.Reply{Persisted: expiry.Clear(req.Key)}
+		case "ttl":
+			outcome = &protocol.Reply{TTL: remainingTTL(kvStore, expiry, req.Key, ts.Wall)}
+		case "begin":
+			// the snapshot holds every write ordered before the begin
+			// the empty commit takes in the writes other levels applied since
+			seq, _, _ := commit(nil)
+			outcome = &protocol.Reply{Snapshot: seq}
+		} // reads are served once the message is delivered
+
+		if outcome != nil && waiting[message.Id] {
+			outcomes[message.Id] = outcome
 		}
-	}()
+	}
 
-	// connection handler for client-to-server messages
-	go func() {
-		for conn := range connQ {
-			// handle connection here
-			buffer := make([]byte, cfg.PayloadSize)
-			size, _ := conn.Read(buffer)
+	// handler for server-to-server broadcasts
+	// messages from one peer are handled in the order they were sent
+	handlePeer := func(message *protocol.Peer) {
+		message.Request.Op = strings.ToLower(message.Request.Op)
 
-			// format {op: 'set', key: key, value: value}
-			// format {op: 'get', key: key}
-			message := make(map[string]string)
-			json.Unmarshal(buffer[:size], &message)
+		// every received message moves the clock past its timestamp
+		hlc.Update(message.Timestamp)
 
-			message["op"] = strings.ToLower(message["op"])
-			// add unique message id
-			message["id"] = strconv.Itoa(rand.Int())
-			// add timestamp to the request
-			timestamp := time.Now().UnixMilli()
-			message["timestamp"] = strconv.FormatInt(timestamp, 10)
-			message["totalOrderTimestamp"] = fmt.Sprintf("%s.%s", message["timestamp"][5:], serverIface)
-
-			// Both read and write are blocking operations
-			if message["op"] == "set" || message["op"] == "get" {
-				msgBytes, _ := json.Marshal(message)
-				BroadcastMsg(msgBytes, serverIface, true, 5)
-
-				if message["op"] == "set" {
-					log.Printf("%d Start : Write %s = %s at server %s\n", timestamp, message["key"], message["value"], clientIface)
+		// fmt.Printf("At %s received {%s: %v}\n", serverIface, message.Request.Op, message.Timestamp)
+		// message is acknowledgement
+		if message.Ack {
+			mu.Lock()
+			_, ok := acks[message.Id]
+			if ok {
+				acks[message.Id]++
+			} else {
+				acks[message.Id] = 1
+			}
+
+			// whenever we got an ack, we check whether the message is deliverable
+			for pq.Len() > 0 {
+				head := heap.Pop(&pq).(*u.Item[*protocol.Peer])
+				// received all the acks for the head
+				if acks[head.Message.Id] == cfg.NumServers {
+					// fmt.Printf("Processing top of the heap {%s: %v} at %s\n", head.Message.Request.Op, head.Timestamp, serverIface)
+					deliver(head.Message)
+
+					// assuming we don't get acks after we receive all acks
+					acks[head.Message.Id] = -1
+					// fmt.Printf("%v\n", acks)
+					// fmt.Printf("PQ len %d\n", pq.Len())
 				} else {
-					log.Printf("%d Start : Read %s at server %s\n", timestamp, message["key"], clientIface)
+					heap.Push(&pq, head)
+					break
 				}
+			}
 
-				// commit the message here
-				for {
-					time.Sleep(time.Millisecond * 10)
-					mu.Lock()
-					ackCount, ok := acks[message["id"]]
-					// fmt.Printf("Ack count for  %d\n", ackCount)
-					mu.Unlock()
-					// when all acks are received, before updating the last ack
-					// separate thread updates the database based on the priority queue
-					if ok && (ackCount == -1) { break }
-				}
+			mu.Unlock()
+			// spawn a go routine if all acks are all received
 
-				if message["op"] == "get" {
-					mu.Lock()
-					val, err := kvStore.Get(ctx, message["key"]).Result()
-					if err != nil {
-						log.Printf("Redis error: %v\n", err)
-					}
-					mu.Unlock()
-					message["value"] = val
-				}
+		} else if isLinearizableOp(message.Request.Op) {
+			// Generating total order based on the hybrid timestamp
+			// ties are broken by the originating server
+			mu.Lock()
+			heap.Push(&pq, &u.Item[*protocol.Peer]{
+				Message: message,
+				Timestamp: message.Timestamp,
+				Node: message.Origin,
+			})
+			top := heap.Pop(&pq).(*u.Item[*protocol.Peer])
+			// fmt.Printf("Top at PQ on %s is {%s: %v}\n", serverIface, top.Message.Request.Op, top.Timestamp)
+			heap.Push(&pq, top)
+			mu.Unlock()
 
-				message["errors"] = ""
+			// serialize the ack, the queued message stays as it is
+			ackMsg := *message
+			ackMsg.Ack = true
+			jsonMsg, _ := json.Marshal(ackMsg)
 
-				if message["op"] == "set" {
-					log.Printf("%d End   : Write %s = %s at server %s\n", time.Now().UnixMilli(), message["key"], message["value"], clientIface)
-				} else {
-					log.Printf("%d End   : Read %s = %s at server %s\n",time.Now().UnixMilli(), message["key"], message["value"], clientIface)
-				}
+			// broadcast ack to all the other servers including itself!
+			if err := bus.Broadcast(jsonMsg, true); err != nil {
+				log.Printf("Broadcast from %s failed: %v\n", serverIface, err)
+			}
+		}
+	}
 
+	// handler for client-to-server requests
+	// requests sharing a connection are served concurrently
+	handleRequest := func(message *protocol.Request) *protocol.Reply {
+		// format {op: 'set', key: key, value: value, ttl: milliseconds}
+		// format {op: 'get', key: key}
+		// format {op: 'del', key: key}
+		// format {op: 'mset', values: {key: value}}
+		// format {op: 'mget', keys: [key]}
+		// format {op: 'ttl', key: key}
+		// format {op: 'persist', key: key}
+		// format {op: 'cas', key: key, value: value, expectedValue: value}
+		// format {op: 'cas', key: key, value: value, expectedVersion: version}
+		// format {op: 'scan', start: key, end: key, prefix: prefix, limit: n, cursor: cursor}
+		// format {op: 'begin'}
+		// format {op: 'txget', key: key, snapshot: snapshot}
+		// format {op: 'txn', snapshot: snapshot, writes: writes}
+		message.Op = strings.ToLower(message.Op)
+		// add timestamp to the request
+		timestamp := clock.Now().UnixMilli()
+		broadcast := &protocol.Peer{
+			Request: *message,
+			// add unique message id
+			Id: nextId(),
+			Origin: serverIface,
+			Timestamp: hlc.Now(),
+		}
+
+		if message.Op == "cas" && message.ExpectedValue == nil && message.ExpectedVersion == nil {
+			return failed(protocol.Errorf(protocol.BadRequest, "cas needs an expectedValue or expectedVersion"))
+		}
+
+		if message.Op == "txget" {
+			// snapshots are immutable, so reads at one need no ordering
+			return readSnapshot(mvcc, message)
+		}
+
+		// a malformed batch is refused before it enters the order
+		var keys []string
+		if message.Op == "mget" || message.Op == "mset" {
+			var bad *protocol.Error
+			if message.Op == "mget" {
+				keys, bad = parseKeys(message)
 			} else {
-				message["error"] = "Client Error!"
+				_, bad = parseValues(message)
+			}
+			if bad != nil {
+				return failed(bad)
 			}
+		}
 
-			res, _ := json.Marshal(message)
-			conn.Write(res)
-			conn.Close()
+		if !isLinearizableOp(message.Op) {
+			return failed(clientError(message.Op))
 		}
-	}()
 
-	// handle connections
-	for {
-		conn, _ := listener.Accept()
-		connQ <- conn
+		// Both read and write are blocking operations
+		mu.Lock()
+		waiting[broadcast.Id] = true
+		mu.Unlock()
+		// a request that gave up leaves no outcome behind
+		defer func() {
+			mu.Lock()
+			delete(waiting, broadcast.Id)
+			delete(outcomes, broadcast.Id)
+			mu.Unlock()
+		}()
+
+		msgBytes, _ := json.Marshal(broadcast)
+		if err := bus.Broadcast(msgBytes, true); err != nil {
+			log.Printf("Broadcast from %s failed: %v\n", serverIface, err)
+			return failed(protocol.Wrap(protocol.Unavailable, err))
+		}
+
+		if message.Op == "set" {
+			log.Printf("%d Start : Write %s = %s at server %s\n", timestamp, message.Key, message.Value, clientIface)
+		} else if message.Op == "del" {
+			log.Printf("%d Start : Delete %s at server %s\n", timestamp, message.Key, clientIface)
+		} else if message.Op == "mset" {
+			log.Printf("%d Start : Write %v at server %s\n", timestamp, message.Values, clientIface)
+		} else if message.Op == "mget" {
+			log.Printf("%d Start : Read %v at server %s\n", timestamp, message.Keys, clientIface)
+		} else if message.Op == "cas" {
+			log.Printf("%d Start : Compare and set %s = %s at server %s\n", timestamp, message.Key, message.Value, clientIface)
+		} else if message.Op == "ttl" || message.Op == "persist" {
+			log.Printf("%d Start : %s %s at server %s\n", timestamp, message.Op, message.Key, clientIface)
+		} else if message.Op == "scan" {
+			log.Printf("%d Start : Scan [%s, %s) at server %s\n", timestamp, message.Start, message.End, clientIface)
+		} else if message.Op == "begin" {
+			log.Printf("%d Start : Begin at server %s\n", timestamp, clientIface)
+		} else if message.Op == "txn" {
+			log.Printf("%d Start : Commit from snapshot %d at server %s\n", timestamp, message.Snapshot, clientIface)
+		} else {
+			log.Printf("%d Start : Read %s at server %s\n", timestamp, message.Key, clientIface)
+		}
+
+		// commit the message here
+		delivered := awaitDelivery(clock, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			// when all acks are received, before updating the last ack
+			// separate thread updates the database based on the priority queue
+			return acks[broadcast.Id] == -1
+		})
+		if !delivered {
+			log.Printf("%d Fail  : %s at server %s: %v\n", clock.Now().UnixMilli(), message.Op, clientIface, errOrderTimeout)
+			return failed(replicaError(bus, cfg.ServerPorts[:cfg.NumServers], errOrderTimeout))
+		}
+
+		reply := &protocol.Reply{}
+		if message.Op == "get" {
+			mu.Lock()
+			entry, err := kvStore.Get(message.Key)
+			if err != nil && err != u.ErrNotFound {
+				log.Printf("Store error: %v\n", err)
+			}
+			mu.Unlock()
+			reply.Value = entry.Value
+			reply.Version = entry.Version
+		} else if message.Op == "mget" {
+			mu.Lock()
+			reply = serveBatch(kvStore, keys)
+			mu.Unlock()
+		} else if message.Op == "scan" {
+			// writes are applied under the same lock, the page is never partial
+			mu.Lock()
+			reply = serveScan(kvStore, message)
+			mu.Unlock()
+		} else if message.Op == "begin" || message.Op == "cas" || message.Op == "txn" || message.Op == "ttl" || message.Op == "persist" {
+			mu.Lock()
+			reply = outcomes[broadcast.Id]
+			mu.Unlock()
+		}
+
+		if message.Op == "set" {
+			log.Printf("%d End   : Write %s = %s at server %s\n", clock.Now().UnixMilli(), message.Key, message.Value, clientIface)
+		} else if message.Op == "del" {
+			log.Printf("%d End   : Delete %s at server %s\n", clock.Now().UnixMilli(), message.Key, clientIface)
+		} else if message.Op == "mset" {
+			log.Printf("%d End   : Write %v at server %s\n", clock.Now().UnixMilli(), message.Values, clientIface)
+		} else if message.Op == "mget" {
+			log.Printf("%d End   : Read %v = %v at server %s\n", clock.Now().UnixMilli(), message.Keys, reply.Values, clientIface)
+		} else if message.Op == "cas" {
+			log.Printf("%d End   : Compare and set %s = %s swapped %t at server %s\n", clock.Now().UnixMilli(), message.Key, message.Value, reply.Swapped, clientIface)
+		} else if message.Op == "ttl" || message.Op == "persist" {
+			log.Printf("%d End   : %s %s ttl %d persisted %t at server %s\n", clock.Now().UnixMilli(), message.Op, message.Key, reply.TTL, reply.Persisted, clientIface)
+		} else if message.Op == "scan" {
+			log.Printf("%d End   : Scan [%s, %s) cursor %s at server %s\n", clock.Now().UnixMilli(), message.Start, message.End, reply.Cursor, clientIface)
+		} else if message.Op == "begin" {
+			log.Printf("%d End   : Begin at snapshot %d at server %s\n", clock.Now().UnixMilli(), reply.Snapshot, clientIface)
+		} else if message.Op == "txn" {
+			log.Printf("%d End   : Commit from snapshot %d committed %t at server %s\n", clock.Now().UnixMilli(), message.Snapshot, reply.Committed, clientIface)
+		} else {
+			log.Printf("%d End   : Read %s = %s at server %s\n",clock.Now().UnixMilli(), message.Key, reply.Value, clientIface)
+		}
+
+		return reply
 	}
+
+	return handleRequest, handlePeer
 }
 
-// broadcasts messages to every other node
-// if from string is empty self broadcast is avoided!
-func BroadcastMsg(message []byte, from string, self bool, delay int) {
-	cfg := u.Config
-	for i := 0; i < cfg.NumServers; i++ {
-		if !self && cfg.ServerPorts[i] == from { continue }
-		go func(to string) {
-			dist := distance(from, to)
-			duration := math.Pow(float64(delay), float64(dist))
-			time.Sleep(time.Millisecond * time.Duration(duration))
-			// log.Printf("Sending msg %s from  %s to %s\n", string(message), from, to)
-			conn, _ := net.Dial(cfg.NetType, cfg.NetAddr + ":" + to)
-			defer conn.Close()
-			conn.Write(message)
-		}(cfg.ServerPorts[i])
+// ops that go through the total order
+func isLinearizableOp(op string) bool {
+	switch op {
+	case "set", "get", "del", "mset", "mget", "cas", "begin", "txn", "scan", "ttl", "persist":
+		return true
+	}
+	return false
+}
+
+// milliseconds the key lives for after now, -1 if it does not expire
+// and -2 if it does not exist
+func remainingTTL(kvStore u.Store, expiry *u.Expirations, key string, now int64) int64 {
+	if _, err := kvStore.Get(key); err != nil || expiry.Expired(key, now) {
+		return -2
+	}
+	at, ok := expiry.Get(key)
+	if !ok {
+		return -1
+	}
+	return at - now
+}
+
+// sets the key if it still holds the expected version or value
+// a missing key has version 0 and the empty value
+func compareAndSet(kvStore u.Store, commit commitFunc, message *protocol.Request) (*protocol.Reply, []u.Write) {
+	current, err := kvStore.Get(message.Key)
+	if err != nil && err != u.ErrNotFound {
+		return failed(protocol.Wrap(protocol.Internal, err)), nil
+	}
+
+	matches := true
+	if message.ExpectedVersion != nil {
+		matches = *message.ExpectedVersion == current.Version
+	}
+	if message.ExpectedValue != nil {
+		matches = matches && *message.ExpectedValue == current.Value
+	}
+
+	outcome := &protocol.Reply{Swapped: matches}
+	var applied []u.Write
+	if matches {
+		if _, applied, err = commit([]u.Write{{Key: message.Key, Value: message.Value}}); err != nil {
+			return failed(protocol.Wrap(protocol.Internal, err)), nil
+		}
+		current, _ = kvStore.Get(message.Key)
+	}
+	outcome.Value = current.Value
+	outcome.Version = current.Version
+	return outcome, applied
+}
+
+// commits the writes of a transaction unless a key it writes was committed
+// after its snapshot, the first committer wins
+func commitTxn(mvcc *u.MVCC, commit commitFunc, message *protocol.Request) (*protocol.Reply, []u.Write) {
+	for _, w := range message.Writes {
+		changed, err := mvcc.ChangedSince(w.Key, message.Snapshot)
+		if err != nil {
+			return failed(storeError(err)), nil
+		}
+		if changed {
+			return &protocol.Reply{Conflict: w.Key}, nil
+		}
+	}
+
+	seq, applied, err := commit(message.Writes)
+	if err != nil {
+		return failed(storeError(err)), nil
+	}
+	return &protocol.Reply{Committed: true, Commit: seq}, applied
+}
+
+// commits writes at the point of the total order being delivered and
+// returns the sequence number and the writes applied
+type commitFunc func(writes []u.Write) (int64, []u.Write, error)
+
+// the keys written no longer expire
+func clearExpiry(expiry *u.Expirations, writes []u.Write) {
+	for _, w := range writes {
+		expiry.Clear(w.Key)
+	}
+}
+
+// serves a read of a transaction at its snapshot
+func readSnapshot(mvcc *u.MVCC, message *protocol.Request) *protocol.Reply {
+	if message.Snapshot > mvcc.Seq() {
+		// snapshots are taken by begin on the same server
+		return failed(protocol.Errorf(protocol.BadRequest, "Unknown snapshot: %d", message.Snapshot))
+	}
+
+	value, ok, err := mvcc.ReadAt(message.Key, message.Snapshot)
+	if err != nil {
+		return failed(storeError(err))
+	}
+	return &protocol.Reply{Value: value, Found: ok}
+}
+
+// polls until the message is delivered, false once orderTimeout has passed
+// a replica that is down or cut off keeps a message from being delivered
+func awaitDelivery(clock Clock, delivered func() bool) bool {
+	deadline := clock.Now().Add(orderTimeout)
+	for {
+		clock.Sleep(time.Millisecond * 10)
+		if delivered() {
+			return true
+		}
+		if clock.Now().After(deadline) {
+			return false
+		}
 	}
 }
 
 func KillAll() {
 	cfg := u.Config
+	closeAll()
 	for i := 0; i < cfg.NumServers; i++ {
-		u.KillRedisClient(cfg.KvStorePorts[i])
+		u.StopStore(cfg.KvStorePorts[i])
 	}
+	forgetCausal()
 }
-
-// Used to generate delays as distance between
-// from addresss and to address
-func distance(from, to string) int {
-	fromInt, _ := strconv.Atoi(from)
-	toInt, _ := strconv.Atoi(to)
-	dist := fromInt - toInt
-	if dist < 0 {
-		dist = -1 * dist
-	}
-	return dist
-}
\ No newline at end of file
@@ -0,0 +1,229 @@
+package services
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+
+	"dist-kv/protocol"
+	u "dist-kv/utils"
+)
+
+// consistency levels a client can ask for on each request
+const (
+	LinearizableLevel = "linearizable"
+	SequentialLevel   = "sequential"
+	EventualLevel     = "eventual"
+	CausalLevel       = "causal"
+)
+
+/*
+	- One cluster serving every consistency level over shared replicas
+	- Each client request picks its level in the "consistency" field,
+	  requests without one are linearizable
+	- Every protocol keeps its own ordering state and peer transport,
+	  peer messages carry the level of the request and are routed by it
+	- The levels share one keyspace, a write at any level is read at
+	  every level. Writes to a key are ordered across levels by their
+	  hybrid timestamps, see sharedKeyspace
+	- A key keeps the guarantees of a level only while it is written at
+	  that level or a stronger one. A linearizable read of a key also
+	  written at eventual level sees whatever its replica has applied
+	- cas and transactions decide on the state of their replica at their
+	  point of the total order. Eventual and causal writes are not in that
+	  order, replicas may decide differently on keys written at those levels
+	- A killed server can not be restarted, as a causal one
+*/
+func StartMixedServer(clientIface, serverIface, kvStoreIface string) error {
+	if err := claimCausal(serverIface); err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	kvStore, err := u.StartStore(ctx, kvStoreIface)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// changes applied to the store are streamed to watchers
+	hub := newWatchHub()
+	kvStore = hub.watch(kvStore)
+
+	listener, err := listen(clientIface, serverIface)
+	if err != nil {
+		return err
+	}
+	intListener, err := listen(serverIface, serverIface) // internal listener
+	if err != nil {
+		return err
+	}
+
+	type mode struct {
+		handleRequest requestHandler
+		handlePeer    peerHandler
+	}
+	modes := map[string]mode{}
+
+	keyspace := newSharedKeyspace(kvStore)
+
+	// every protocol sends over a transport of its own
+	add := func(level string, newProtocol func(string, string, u.Store, Bus, Clock, *rand.Rand) (requestHandler, peerHandler)) {
+		store := &levelStore{Store: kvStore, keyspace: keyspace, level: level}
+		handleRequest, handlePeer := newProtocol(clientIface, serverIface, store, NewTransport(serverIface), realClock{}, newRand())
+		modes[level] = mode{handleRequest, handlePeer}
+	}
+	add(LinearizableLevel, newLinearizable)
+	add(SequentialLevel, newSequential)
+	add(EventualLevel, newEventual)
+	add(CausalLevel, newCausal)
+
+	go servePeers(intListener, func(message *protocol.Peer) {
+		m, ok := modes[message.Request.Consistency]
+		if !ok {
+			log.Printf("Dropping peer message with consistency %q at %s\n", message.Request.Consistency, serverIface)
+			return
+		}
+		m.handlePeer(message)
+	})
+
+	// handle connections until the server is killed
+	return serveClients(listener, func(message *protocol.Request) *protocol.Reply {
+		level := strings.ToLower(message.Consistency)
+		if level == "" {
+			level = LinearizableLevel
+		}
+
+		m, ok := modes[level]
+		if !ok {
+			return failed(protocol.Errorf(protocol.BadRequest, "Unknown consistency level: %s", message.Consistency))
+		}
+
+		// broadcasts copy the request, so peers see the level too
+		message.Consistency = level
+		return m.handleRequest(message)
+	}, hub)
+}
+
+/*
+	The keyspace the levels of a mixed server share
+	- every write is stamped with the hybrid timestamp it was ordered at,
+	  the server it came from and its level. A write is applied only if
+	  its stamp is after the stamp of the last write to the key, so every
+	  replica keeps the same winner whatever order the writes of the
+	  levels reach it in
+	- the levels order their own writes by the same timestamps, a level
+	  never sees its writes reordered by the others
+	- an expiry is a delete at the time the key expires
+	- writes of every level reach the MVCC of the linearizable level,
+	  transaction snapshots see them
+	- the stamps of deleted keys are kept for as long as the server runs
+*/
+type sharedKeyspace struct {
+	mu     sync.Mutex
+	mvcc   *u.MVCC
+	stamps map[string]writeStamp // last write applied to every key
+}
+
+type writeStamp struct {
+	ts     u.Timestamp
+	origin string
+	level  string
+}
+
+func (s writeStamp) before(other writeStamp) bool {
+	if s.ts != other.ts {
+		return s.ts.Less(other.ts)
+	}
+	if s.origin != other.origin {
+		return s.origin < other.origin
+	}
+	return s.level < other.level
+}
+
+func newSharedKeyspace(kvStore u.Store) *sharedKeyspace {
+	return &sharedKeyspace{
+		mvcc:   u.NewMVCC(kvStore, u.DefaultRetainCommits),
+		stamps: make(map[string]writeStamp),
+	}
+}
+
+// true if the write is after the last one to its key, it becomes the last one
+// callers hold k.mu
+func (k *sharedKeyspace) admit(key string, stamp writeStamp) bool {
+	if current, ok := k.stamps[key]; ok && !current.before(stamp) {
+		return false
+	}
+	k.stamps[key] = stamp
+	return true
+}
+
+// the store one level of a mixed server writes through
+type levelStore struct {
+	u.Store
+	keyspace *sharedKeyspace
+	level    string
+}
+
+// the MVCC over the store, shared by the levels of a mixed server
+func mvccOf(kvStore u.Store) *u.MVCC {
+	if ls, ok := kvStore.(*levelStore); ok {
+		return ls.keyspace.mvcc
+	}
+	return u.NewMVCC(kvStore, u.DefaultRetainCommits)
+}
+
+// applies a write ordered at ts by origin, false if a later write to
+// the key was applied at another level of a mixed server
+func applyAt(kvStore u.Store, ts u.Timestamp, origin string, w u.Write) (bool, error) {
+	ls, ok := kvStore.(*levelStore)
+	if !ok {
+		if w.Delete {
+			return true, kvStore.Delete(w.Key)
+		}
+		_, err := kvStore.Set(w.Key, w.Value)
+		return err == nil, err
+	}
+
+	k := ls.keyspace
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !k.admit(w.Key, writeStamp{ts, origin, ls.level}) {
+		return false, nil
+	}
+	return true, k.mvcc.Apply(w)
+}
+
+// commits the writes ordered at ts by origin and returns the ones applied
+// on a mixed server writes older than the last write to their key are
+// left out, the commit is made even if none is left so replicas agree
+// on the sequence numbers
+func commitAt(kvStore u.Store, mvcc *u.MVCC, ts u.Timestamp, origin string, writes []u.Write) (int64, []u.Write, error) {
+	ls, ok := kvStore.(*levelStore)
+	if !ok {
+		seq, err := mvcc.Commit(writes)
+		return seq, writes, err
+	}
+
+	k := ls.keyspace
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	applied := make([]u.Write, 0, len(writes))
+	for _, w := range writes {
+		if k.admit(w.Key, writeStamp{ts, origin, ls.level}) {
+			applied = append(applied, w)
+		}
+	}
+	seq, err := mvcc.Commit(applied)
+	return seq, applied, err
+}
+
+// calls expire for every key expired at now with the time it expired at
+// an expiry is a delete at that time, every replica stamps it the same
+func forExpired(expiry *u.Expirations, now int64, expire func(key string, at u.Timestamp)) {
+	for at, ok := expiry.Next(); ok && at <= now; at, ok = expiry.Next() {
+		for _, key := range expiry.Due(at) {
+			expire(key, u.Timestamp{Wall: at})
+		}
+	}
+}
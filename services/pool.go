@@ -0,0 +1,255 @@
+package services
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dist-kv/protocol"
+	u "dist-kv/utils"
+)
+
+// connections kept open per client when PoolSize is not set
+const DefaultPoolSize = 4
+
+// longest a client waits for a reply when Timeout is not set
+// longer than servers wait on their own, so their Timeout arrives first
+const DefaultTimeout = 10 * time.Second
+
+var (
+	errConnClosed  = errors.New("connection closed")
+	errCallTimeout = errors.New("no reply before the deadline")
+)
+
+/*
+A long lived client connection carrying many requests at once
+  - every request is tagged with a client generated "reqId"
+  - a reader goroutine matches responses to requests by reqId,
+    so the server may answer them out of order
+  - a streaming request gets every response under its reqId until
+    one marked "done"
+*/
+type clientConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	pending map[string]chan *protocol.Reply
+	streams map[string]chan *protocol.Reply
+	err     error // set once the connection is broken
+}
+
+func dialClientConn(iface string) (*clientConn, error) {
+	conn, err := net.Dial(u.Config.NetType, u.Config.NetAddr+":"+iface)
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &clientConn{
+		conn:    conn,
+		pending: make(map[string]chan *protocol.Reply),
+		streams: make(map[string]chan *protocol.Reply),
+	}
+	go cc.readLoop()
+	return cc, nil
+}
+
+// sends the request and returns a channel receiving its response
+func (cc *clientConn) send(reqId string, payload *protocol.Request) (chan *protocol.Reply, error) {
+	return cc.request(reqId, payload, cc.pending, 1)
+}
+
+// sends a streaming request and returns a channel receiving its responses
+// the channel is closed after the last one, or if the reader falls behind
+func (cc *clientConn) stream(reqId string, payload *protocol.Request, buffer int) (chan *protocol.Reply, error) {
+	return cc.request(reqId, payload, cc.streams, buffer)
+}
+
+func (cc *clientConn) request(reqId string, payload *protocol.Request, waiting map[string]chan *protocol.Reply, buffer int) (chan *protocol.Reply, error) {
+	ch := make(chan *protocol.Reply, buffer)
+
+	cc.mu.Lock()
+	if cc.err != nil {
+		cc.mu.Unlock()
+		return nil, cc.err
+	}
+	waiting[reqId] = ch
+	cc.mu.Unlock()
+
+	payload.ReqId = reqId
+	cc.writeMu.Lock()
+	err := writeMessage(cc.conn, payload)
+	cc.writeMu.Unlock()
+
+	if err != nil {
+		cc.mu.Lock()
+		delete(waiting, reqId)
+		cc.mu.Unlock()
+		// a failed write may leave half a frame behind
+		if err != u.ErrFrameTooLarge {
+			cc.fail(err)
+		}
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (cc *clientConn) readLoop() {
+	for {
+		response := &protocol.Reply{}
+		if err := readMessage(cc.conn, response); err != nil {
+			cc.fail(err)
+			return
+		}
+
+		cc.mu.Lock()
+		reqId := response.ReqId
+		if ch, ok := cc.pending[reqId]; ok {
+			delete(cc.pending, reqId)
+			ch <- response
+		} else if ch, ok := cc.streams[reqId]; ok {
+			// a slow stream must not hold up the other requests
+			select {
+			case ch <- response:
+				if response.Done {
+					delete(cc.streams, reqId)
+					close(ch)
+				}
+			default:
+				delete(cc.streams, reqId)
+				close(ch)
+			}
+		}
+		cc.mu.Unlock()
+	}
+}
+
+// breaks the connection and fails every request still waiting on it
+func (cc *clientConn) fail(err error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cc.err != nil {
+		return
+	}
+	cc.err = err
+	cc.conn.Close()
+	for reqId, ch := range cc.pending {
+		close(ch)
+		delete(cc.pending, reqId)
+	}
+	for reqId, ch := range cc.streams {
+		close(ch)
+		delete(cc.streams, reqId)
+	}
+}
+
+// stops waiting for the response to the request
+func (cc *clientConn) forget(reqId string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	delete(cc.pending, reqId)
+}
+
+func (cc *clientConn) broken() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.err != nil
+}
+
+// a fixed size set of connections to one server used round robin
+type connPool struct {
+	mu    sync.Mutex
+	iface string
+	conns []*clientConn
+	next  int
+	reqId uint64
+}
+
+func newConnPool(iface string, size int) *connPool {
+	if size <= 0 {
+		size = DefaultPoolSize
+	}
+	return &connPool{iface: iface, conns: make([]*clientConn, size)}
+}
+
+// issues a request on the next connection and blocks for its response
+// gives up after timeout, a late response is dropped
+func (p *connPool) call(payload *protocol.Request, timeout time.Duration) (*protocol.Reply, error) {
+	cc, err := p.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	reqId := p.nextReqId()
+	ch, err := cc.send(reqId, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case response, ok := <-ch:
+		if !ok {
+			return nil, errConnClosed
+		}
+		return response, nil
+	case <-timer.C:
+		cc.forget(reqId)
+		return nil, errCallTimeout
+	}
+}
+
+// issues a streaming request on the next connection
+// returns the connection and reqId the stream is tied to
+func (p *connPool) stream(payload *protocol.Request, buffer int) (*clientConn, string, chan *protocol.Reply, error) {
+	cc, err := p.conn()
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	reqId := p.nextReqId()
+	ch, err := cc.stream(reqId, payload, buffer)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return cc, reqId, ch, nil
+}
+
+func (p *connPool) nextReqId() string {
+	return strconv.FormatUint(atomic.AddUint64(&p.reqId, 1), 10)
+}
+
+// the next connection, broken connections are redialed lazily
+func (p *connPool) conn() (*clientConn, error) {
+	p.mu.Lock()
+	slot := p.next
+	p.next = (p.next + 1) % len(p.conns)
+	cc := p.conns[slot]
+	if cc == nil || cc.broken() {
+		var err error
+		cc, err = dialClientConn(p.iface)
+		if err != nil {
+			p.mu.Unlock()
+			return nil, err
+		}
+		p.conns[slot] = cc
+	}
+	p.mu.Unlock()
+	return cc, nil
+}
+
+func (p *connPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, cc := range p.conns {
+		if cc != nil {
+			cc.fail(errConnClosed)
+			p.conns[i] = nil
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"dist-kv/protocol"
+	u "dist-kv/utils"
+)
+
+const quorumTimeout = 2 * time.Second
+
+var errNoQuorum = errors.New("timed out waiting for quorum")
+
+/*
+	- Dynamo style quorum replication
+	- Every key lives on N replicas picked by hashing the key
+	- A write completes after W replicas stored it, a read after R replied
+	- Values are versioned by the coordinator, replicas keep the newest version
+	- Reads return the newest version among the responders and repair stale ones
+	- R + W > N makes every read overlap the latest completed write
+*/
+func StartQuorumServer(clientIface, serverIface, kvStoreIface string) error {
+	ctx := context.Background()
+	n, r, w := quorumConfig()
+
+	kvStore, err := u.StartStore(ctx, kvStoreIface)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// changes applied to the store are streamed to watchers
+	hub := newWatchHub()
+	kvStore = hub.watch(kvStore)
+
+	listener, err := listen(clientIface, serverIface)
+	if err != nil {
+		return err
+	}
+	intListener, err := listen(serverIface, serverIface) // internal listener
+	if err != nil {
+		return err
+	}
+	transport := NewTransport(serverIface)
+	// ids of the requests this server sends to the replicas
+	nextId := newIds(serverIface, newRand())
+
+	var mu sync.Mutex
+	// replies of in flight replica requests by request id
+	pending := map[string]chan protocol.QuorumMessage{}
+	var lastVersion int64
+
+	send := func(to string, message protocol.QuorumMessage) error {
+		jsonMsg, _ := json.Marshal(message)
+		err := transport.Send(to, jsonMsg)
+		if err != nil {
+			log.Printf("Send from %s to %s failed: %v\n", serverIface, to, err)
+		}
+		return err
+	}
+
+	// sends the request to every replica of the key and collects
+	// the first needed replies
+	// Unavailable if too few replicas can be reached, Timeout if they are too slow
+	scatter := func(message protocol.QuorumMessage, needed int) ([]protocol.QuorumMessage, *protocol.Error) {
+		reqId := nextId()
+		replies := make(chan protocol.QuorumMessage, n)
+		mu.Lock()
+		pending[reqId] = replies
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			delete(pending, reqId)
+			mu.Unlock()
+		}()
+
+		message.ReqId = reqId
+		message.From = serverIface
+		replicas := preferenceList(message.Key, n)
+		sent := 0
+		var sendErr error
+		for _, to := range replicas {
+			if err := send(to, message); err != nil {
+				sendErr = err
+			} else {
+				sent++
+			}
+		}
+		if sent < needed {
+			return nil, protocol.Wrap(protocol.Unavailable, sendErr)
+		}
+
+		collected := make([]protocol.QuorumMessage, 0, needed)
+		answered := map[string]bool{}
+		timeout := time.After(quorumTimeout)
+		for len(collected) < needed {
+			select {
+			case reply := <-replies:
+				// a duplicated reply counts once
+				if !answered[reply.From] {
+					answered[reply.From] = true
+					collected = append(collected, reply)
+				}
+			case <-timeout:
+				return collected, replicaError(transport, replicas, errNoQuorum)
+			}
+		}
+		return collected, nil
+	}
+
+	// handler for server-to-server messages
+	// messages from one peer are handled in the order they were sent
+	handlePeer := func(payload []byte) {
+		message := protocol.QuorumMessage{}
+		if err := json.Unmarshal(payload, &message); err != nil {
+			log.Printf("Dropping malformed quorum message at %s: %v\n", serverIface, err)
+			return
+		}
+
+		switch message.Op {
+		case "replicate":
+			// older versions are ignored, the ack still counts
+			kvStore.Put(message.Key, message.Value, message.Version)
+			send(message.From, protocol.QuorumMessage{
+				Op: "replicated",
+				ReqId: message.ReqId,
+				From: serverIface,
+			})
+
+		case "fetch":
+			reply := protocol.QuorumMessage{
+				Op: "fetched",
+				ReqId: message.ReqId,
+				From: serverIface,
+			}
+			entry, err := kvStore.Get(message.Key)
+			if err == nil {
+				reply.Value = entry.Value
+				reply.Version = entry.Version
+			}
+			send(message.From, reply)
+
+		case "replicated", "fetched":
+			mu.Lock()
+			replies, ok := pending[message.ReqId]
+			mu.Unlock()
+			// late replies of finished requests are dropped, and so are
+			// extra ones once the buffer is full, the peer reader never blocks
+			if ok {
+				select {
+				case replies <- message:
+				default:
+				}
+			}
+		}
+	}
+	go servePeerFrames(intListener, handlePeer)
+
+	// handler for client-to-server requests
+	// requests sharing a connection are served concurrently
+	handleRequest := func(message *protocol.Request) *protocol.Reply {
+		message.Op = strings.ToLower(message.Op)
+		timestamp := time.Now().UnixMilli()
+
+		if message.TTL != 0 {
+			return failed(clientError("ttl"))
+		}
+
+		reply := &protocol.Reply{}
+		if message.Op == "set" {
+			log.Printf("%d Start : Write %s = %s at server %s\n", timestamp, message.Key, message.Value, clientIface)
+
+			// versions only move forward on a coordinator
+			mu.Lock()
+			version := time.Now().UnixNano()
+			if version <= lastVersion {
+				version = lastVersion + 1
+			}
+			lastVersion = version
+			mu.Unlock()
+
+			_, err := scatter(protocol.QuorumMessage{
+				Op: "replicate",
+				Key: message.Key,
+				Value: message.Value,
+				Version: version,
+			}, w)
+			if err != nil {
+				return failed(err)
+			}
+
+			reply.Version = version
+			log.Printf("%d End   : Write %s = %s version %d at server %s\n", time.Now().UnixMilli(), message.Key, message.Value, reply.Version, clientIface)
+
+		} else if message.Op == "get" {
+			log.Printf("%d Start : Read %s at server %s\n", timestamp, message.Key, clientIface)
+
+			replies, err := scatter(protocol.QuorumMessage{
+				Op: "fetch",
+				Key: message.Key,
+			}, r)
+			if err != nil {
+				return failed(err)
+			}
+
+			newest := replies[0]
+			for _, replica := range replies {
+				if replica.Version > newest.Version {
+					newest = replica
+				}
+			}
+
+			// read repair for responders holding an older version
+			for _, replica := range replies {
+				if replica.Version < newest.Version {
+					send(replica.From, protocol.QuorumMessage{
+						Op: "replicate",
+						Key: message.Key,
+						Value: newest.Value,
+						Version: newest.Version,
+						From: serverIface,
+					})
+				}
+			}
+
+			if newest.Version == 0 {
+				reply.Value = "nil"
+			} else {
+				reply.Value = newest.Value
+			}
+			reply.Version = newest.Version
+			log.Printf("%d End   : Read %s = %s version %d at server %s\n", time.Now().UnixMilli(), message.Key, reply.Value, reply.Version, clientIface)
+
+		} else if message.Op == "scan" {
+			// keys live on their preference lists, no replica holds a whole range
+			return failed(protocol.Errorf(protocol.Unsupported, "scan is not supported in quorum mode"))
+		} else if message.Op == "del" {
+			// replicas keep the newest version and no tombstones, a delete
+			// could be undone by any replica still holding the value
+			return failed(protocol.Errorf(protocol.Unsupported, "del is not supported in quorum mode"))
+		} else {
+			return failed(clientError(message.Op))
+		}
+
+		return reply
+	}
+
+	// handle connections until the server is killed
+	return serveClients(listener, handleRequest, hub)
+}
+
+// N, R and W from the config, defaulting to majorities of the cluster
+func quorumConfig() (n, r, w int) {
+	cfg := u.Config
+	n = cfg.QuorumN
+	if n <= 0 || n > cfg.NumServers {
+		n = cfg.NumServers
+	}
+	r = cfg.QuorumR
+	if r <= 0 || r > n {
+		r = n/2 + 1
+	}
+	w = cfg.QuorumW
+	if w <= 0 || w > n {
+		w = n/2 + 1
+	}
+	return n, r, w
+}
+
+// the N servers responsible for the key, every server computes the same list
+func preferenceList(key string, n int) []string {
+	cfg := u.Config
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	start := int(hash.Sum32() % uint32(cfg.NumServers))
+
+	replicas := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		replicas = append(replicas, cfg.ServerPorts[(start + i) % cfg.NumServers])
+	}
+	return replicas
+}
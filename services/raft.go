@@ -0,0 +1,672 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"dist-kv/protocol"
+	u "dist-kv/utils"
+)
+
+const (
+	heartbeatInterval  = 50 * time.Millisecond
+	electionTimeoutMin = 300 * time.Millisecond
+	electionTimeoutMax = 600 * time.Millisecond
+	raftRequestTimeout = 5 * time.Second
+	// entries shipped per AppendEntries message
+	maxAppendEntries = 100
+)
+
+const (
+	follower = iota
+	candidate
+	leader
+)
+
+var (
+	errNotLeader   = errors.New("not leader")
+	errRaftTimeout = errors.New("request timed out")
+)
+
+type raftResult struct {
+	reply *protocol.Reply
+	err   error
+}
+
+// a client request waiting for its log entry to be applied
+type raftWaiter struct {
+	id string
+	ch chan raftResult
+}
+
+type raftNode struct {
+	mu        sync.Mutex
+	self      string
+	peers     []string
+	transport *Transport
+	kvStore   u.Store
+	storage   *raftStorage
+	expiry    *u.Expirations // deadlines of the applied writes with a ttl
+
+	role     int
+	term     int64
+	votedFor string
+	leaderId string
+	votes    map[string]bool // servers that granted their vote this term, self included
+
+	rlog        []protocol.RaftEntry // rlog[0] is a sentinel, the log starts at index 1
+	commitIndex int
+	lastApplied int
+	nextIndex   map[string]int
+	matchIndex  map[string]int
+
+	lastHeard       time.Time
+	lastHeartbeat   time.Time
+	electionTimeout time.Duration
+	rand            *rand.Rand // draws election timeouts, guarded by mu
+	nextId          func() string
+
+	waiters    map[int]raftWaiter
+	forwarders map[string]*connPool
+	done       chan struct{}
+	closed     bool
+}
+
+/*
+	- Raft consensus for linearizable replication
+	- Leader election with randomized timeouts
+	- Reads and writes are appended to the replicated log and applied in log order
+	- An entry commits once a majority of the servers store it,
+	  so the cluster keeps serving with a minority of servers down
+	- Followers forward client requests to the current leader
+	- Term, vote and log are saved in the data directory, see raftlog.go
+	- The log is the durable copy of the data, a restarted server replays
+	  it onto an empty memory store, durable stores would apply it twice
+	- Keys expire at the leader timestamp of their write plus the ttl, an
+	  entry deletes the keys due at its timestamp before it is applied, so
+	  every server and every replay expires them at the same point of the log
+*/
+func StartRaftServer(clientIface, serverIface, kvStoreIface string) error {
+	cfg := u.Config
+	ctx := context.Background()
+
+	if cfg.Storage != u.MemoryStorage {
+		return fmt.Errorf("raft mode needs memory storage, got %q", cfg.Storage)
+	}
+	storage, state, rlog, err := openRaftStorage(raftDir(serverIface), cfg.Fsync)
+	if err != nil {
+		return err
+	}
+
+	kvStore, err := u.StartStore(ctx, kvStoreIface)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// changes applied to the store are streamed to watchers
+	hub := newWatchHub()
+	kvStore = hub.watch(kvStore)
+
+	listener, err := listen(clientIface, serverIface)
+	if err != nil {
+		return err
+	}
+	intListener, err := listen(serverIface, serverIface) // internal listener
+	if err != nil {
+		return err
+	}
+
+	r := &raftNode{
+		self:       serverIface,
+		transport:  NewTransport(serverIface),
+		kvStore:    kvStore,
+		storage:    storage,
+		expiry:     u.NewExpirations(),
+		term:       state.Term,
+		votedFor:   state.VotedFor,
+		rlog:       rlog,
+		nextIndex:  make(map[string]int),
+		matchIndex: make(map[string]int),
+		waiters:    make(map[int]raftWaiter),
+		forwarders: make(map[string]*connPool),
+		done:       make(chan struct{}),
+		lastHeard:  time.Now(),
+		rand:       newRand(),
+	}
+	r.nextId = newIds(serverIface, r.rand)
+	for i := 0; i < cfg.NumServers; i++ {
+		if cfg.ServerPorts[i] != serverIface {
+			r.peers = append(r.peers, cfg.ServerPorts[i])
+		}
+	}
+	r.resetElectionTimeout()
+	track(serverIface, r)
+
+	go servePeerFrames(intListener, r.handlePeer)
+	go r.run()
+
+	// handle connections until the server is killed
+	return serveClients(listener, func(message *protocol.Request) *protocol.Reply {
+		return r.handleRequest(clientIface, message)
+	}, hub)
+}
+
+func (r *raftNode) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.closed {
+		r.closed = true
+		close(r.done)
+		r.storage.Close()
+		for _, pool := range r.forwarders {
+			pool.close()
+		}
+	}
+	return nil
+}
+
+func (r *raftNode) handleRequest(clientIface string, message *protocol.Request) *protocol.Reply {
+	message.Op = strings.ToLower(message.Op)
+	timestamp := time.Now().UnixMilli()
+
+	switch message.Op {
+	case "set", "get", "del", "scan", "ttl", "persist":
+	default:
+		return failed(clientError(message.Op))
+	}
+
+	if message.Op == "set" {
+		log.Printf("%d Start : Write %s = %s at server %s\n", timestamp, message.Key, message.Value, clientIface)
+	} else if message.Op == "del" {
+		log.Printf("%d Start : Delete %s at server %s\n", timestamp, message.Key, clientIface)
+	} else if message.Op == "scan" {
+		log.Printf("%d Start : Scan [%s, %s) at server %s\n", timestamp, message.Start, message.End, clientIface)
+	} else if message.Op == "ttl" || message.Op == "persist" {
+		log.Printf("%d Start : %s %s at server %s\n", timestamp, message.Op, message.Key, clientIface)
+	} else {
+		log.Printf("%d Start : Read %s at server %s\n", timestamp, message.Key, clientIface)
+	}
+
+	reply, err := r.submit(message)
+	if err != nil {
+		log.Printf("%d Fail  : %s %s at server %s: %v\n", time.Now().UnixMilli(), message.Op, message.Key, clientIface, err)
+		return failed(raftError(err))
+	}
+
+	if message.Op == "set" {
+		log.Printf("%d End   : Write %s = %s at server %s\n", time.Now().UnixMilli(), message.Key, message.Value, clientIface)
+	} else if message.Op == "del" {
+		log.Printf("%d End   : Delete %s at server %s\n", time.Now().UnixMilli(), message.Key, clientIface)
+	} else if message.Op == "scan" {
+		log.Printf("%d End   : Scan cursor %s at server %s\n", time.Now().UnixMilli(), reply.Cursor, clientIface)
+	} else if message.Op == "ttl" || message.Op == "persist" {
+		log.Printf("%d End   : %s %s ttl %d persisted %t at server %s\n", time.Now().UnixMilli(), message.Op, message.Key, reply.TTL, reply.Persisted, clientIface)
+	} else {
+		log.Printf("%d End   : Read %s = %s at server %s\n", time.Now().UnixMilli(), message.Key, reply.Value, clientIface)
+	}
+	return reply
+}
+
+// the error code of a failed request, errors of a forwarding leader keep theirs
+func raftError(err error) *protocol.Error {
+	if err == errNotLeader {
+		return protocol.Wrap(protocol.NotLeader, err)
+	} else if err == errRaftTimeout {
+		return protocol.Wrap(protocol.Timeout, err)
+	}
+	return storeError(err)
+}
+
+// appends the request to the log on the leader and waits until it is applied
+// on a follower the request is forwarded to the leader
+// a leader that could not be reached is reported once the time is up
+func (r *raftNode) submit(message *protocol.Request) (*protocol.Reply, error) {
+	deadline := time.Now().Add(raftRequestTimeout)
+	var forwardErr error
+
+	for time.Now().Before(deadline) {
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			return nil, errNotLeader
+		}
+		if r.role == leader {
+			entry := protocol.RaftEntry{
+				Term: r.term,
+				// add unique message id
+				Id: r.nextId(),
+				Request: *message,
+				Timestamp: r.timestamp(),
+			}
+			entry.Request.Forwarded = ""
+			r.rlog = append(r.rlog, entry)
+			index := r.lastIndex()
+			ch := make(chan raftResult, 1)
+			r.waiters[index] = raftWaiter{id: entry.Id, ch: ch}
+
+			// a single server cluster commits right away
+			r.advanceCommit()
+			r.sendAppends()
+			r.mu.Unlock()
+
+			select {
+			case res := <-ch:
+				return res.reply, res.err
+			case <-time.After(time.Until(deadline)):
+				r.mu.Lock()
+				if w, ok := r.waiters[index]; ok && w.id == entry.Id {
+					delete(r.waiters, index)
+				}
+				r.mu.Unlock()
+				return nil, errRaftTimeout
+			}
+		}
+		leaderId := r.leaderId
+		r.mu.Unlock()
+
+		// forwarded requests are never forwarded again
+		if message.Forwarded != "" {
+			return nil, errNotLeader
+		}
+
+		if leaderId != "" {
+			response, err := r.forward(leaderId, message)
+			forwardErr = err
+			if err == nil && response.Error == nil {
+				return response, nil
+			} else if err == nil && response.Error.Code != protocol.NotLeader {
+				return nil, response.Error
+			}
+			// the leader is unreachable or moved, retry after the next election
+		}
+
+		time.Sleep(heartbeatInterval)
+	}
+
+	if forwardErr != nil {
+		return nil, connError(forwardErr)
+	}
+	return nil, errRaftTimeout
+}
+
+// sends the request to the client port of the leader
+func (r *raftNode) forward(leaderId string, message *protocol.Request) (*protocol.Reply, error) {
+	cfg := u.Config
+	clientIface := ""
+	for i := 0; i < cfg.NumServers; i++ {
+		if cfg.ServerPorts[i] == leaderId {
+			clientIface = cfg.ClientPorts[i]
+		}
+	}
+
+	r.mu.Lock()
+	pool, ok := r.forwarders[clientIface]
+	if !ok {
+		pool = newConnPool(clientIface, 1)
+		r.forwarders[clientIface] = pool
+	}
+	r.mu.Unlock()
+
+	payload := *message
+	payload.Forwarded = r.self
+	return pool.call(&payload, raftRequestTimeout)
+}
+
+// drives elections and heartbeats
+func (r *raftNode) run() {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+
+		r.mu.Lock()
+		if r.role == leader {
+			if time.Since(r.lastHeartbeat) >= heartbeatInterval {
+				r.sendAppends()
+			}
+		} else if time.Since(r.lastHeard) >= r.electionTimeout {
+			r.startElection()
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *raftNode) handlePeer(payload []byte) {
+	msg := protocol.RaftMessage{}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		log.Printf("Dropping malformed raft message at %s: %v\n", r.self, err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+	if msg.Term > r.term {
+		r.stepDown(msg.Term)
+	}
+
+	switch msg.Type {
+	case "requestVote":
+		r.handleRequestVote(msg)
+	case "vote":
+		if r.role == candidate && msg.Term == r.term && msg.Granted {
+			// a grant delivered twice is still one vote
+			r.votes[msg.From] = true
+			if len(r.votes)*2 > len(r.peers)+1 {
+				r.becomeLeader()
+			}
+		}
+	case "appendEntries":
+		r.handleAppendEntries(msg)
+	case "appendReply":
+		r.handleAppendReply(msg)
+	}
+}
+
+// callers hold r.mu
+func (r *raftNode) handleRequestVote(msg protocol.RaftMessage) {
+	lastTerm := r.rlog[r.lastIndex()].Term
+	upToDate := msg.LastLogTerm > lastTerm ||
+		(msg.LastLogTerm == lastTerm && msg.LastLogIndex >= r.lastIndex())
+
+	granted := msg.Term == r.term && upToDate &&
+		(r.votedFor == "" || r.votedFor == msg.From)
+	if granted {
+		r.votedFor = msg.From
+		r.lastHeard = time.Now()
+	}
+
+	r.send(msg.From, protocol.RaftMessage{Type: "vote", Term: r.term, Granted: granted})
+}
+
+// callers hold r.mu
+func (r *raftNode) handleAppendEntries(msg protocol.RaftMessage) {
+	reply := protocol.RaftMessage{Type: "appendReply", Term: r.term}
+	if msg.Term < r.term {
+		r.send(msg.From, reply)
+		return
+	}
+
+	r.role = follower
+	r.leaderId = msg.From
+	r.lastHeard = time.Now()
+
+	// the log does not contain the entry preceding the new ones
+	if msg.PrevLogIndex > r.lastIndex() || r.rlog[msg.PrevLogIndex].Term != msg.PrevLogTerm {
+		reply.MatchIndex = r.lastIndex()
+		if msg.PrevLogIndex <= r.lastIndex() {
+			reply.MatchIndex = msg.PrevLogIndex - 1
+		}
+		r.send(msg.From, reply)
+		return
+	}
+
+	for i, entry := range msg.Entries {
+		index := msg.PrevLogIndex + 1 + i
+		if index <= r.lastIndex() && r.rlog[index].Term != entry.Term {
+			// drop the conflicting suffix
+			r.rlog = r.rlog[:index]
+		}
+		if index > r.lastIndex() {
+			r.rlog = append(r.rlog, entry)
+		}
+	}
+
+	match := msg.PrevLogIndex + len(msg.Entries)
+	// only ever moves forward, a duplicated or reordered message can be
+	// older than the last one
+	commit := msg.LeaderCommit
+	if match < commit {
+		commit = match
+	}
+	if commit > r.commitIndex {
+		r.commitIndex = commit
+		r.apply()
+	}
+
+	reply.Success = true
+	reply.MatchIndex = match
+	r.send(msg.From, reply)
+}
+
+// callers hold r.mu
+func (r *raftNode) handleAppendReply(msg protocol.RaftMessage) {
+	if r.role != leader || msg.Term != r.term {
+		return
+	}
+
+	if msg.Success {
+		if msg.MatchIndex > r.matchIndex[msg.From] {
+			r.matchIndex[msg.From] = msg.MatchIndex
+		}
+		r.nextIndex[msg.From] = r.matchIndex[msg.From] + 1
+		r.advanceCommit()
+		return
+	}
+
+	// back off and retry right away
+	next := r.nextIndex[msg.From] - 1
+	if msg.MatchIndex+1 < next {
+		next = msg.MatchIndex + 1
+	}
+	if next < 1 {
+		next = 1
+	}
+	r.nextIndex[msg.From] = next
+	r.sendAppend(msg.From)
+}
+
+// callers hold r.mu
+func (r *raftNode) startElection() {
+	r.term++
+	r.role = candidate
+	r.votedFor = r.self
+	r.leaderId = ""
+	r.votes = map[string]bool{r.self: true}
+	r.lastHeard = time.Now()
+	r.resetElectionTimeout()
+
+	if len(r.votes)*2 > len(r.peers)+1 {
+		r.becomeLeader()
+		return
+	}
+
+	for _, peer := range r.peers {
+		r.send(peer, protocol.RaftMessage{
+			Type:         "requestVote",
+			Term:         r.term,
+			LastLogIndex: r.lastIndex(),
+			LastLogTerm:  r.rlog[r.lastIndex()].Term,
+		})
+	}
+}
+
+// callers hold r.mu
+func (r *raftNode) becomeLeader() {
+	log.Printf("Server %s is the leader for term %d\n", r.self, r.term)
+	r.role = leader
+	r.leaderId = r.self
+	for _, peer := range r.peers {
+		r.nextIndex[peer] = r.lastIndex() + 1
+		r.matchIndex[peer] = 0
+	}
+
+	// entries of earlier terms only commit along with one of the current term
+	r.rlog = append(r.rlog, protocol.RaftEntry{Term: r.term, Request: protocol.Request{Op: "noop"}, Timestamp: r.timestamp()})
+	r.advanceCommit()
+	r.sendAppends()
+}
+
+// callers hold r.mu
+func (r *raftNode) stepDown(term int64) {
+	r.term = term
+	r.role = follower
+	r.votedFor = ""
+}
+
+// callers hold r.mu
+func (r *raftNode) sendAppends() {
+	for _, peer := range r.peers {
+		r.sendAppend(peer)
+	}
+	r.lastHeartbeat = time.Now()
+}
+
+// callers hold r.mu
+func (r *raftNode) sendAppend(peer string) {
+	prev := r.nextIndex[peer] - 1
+	end := r.lastIndex() + 1
+	if end-(prev+1) > maxAppendEntries {
+		end = prev + 1 + maxAppendEntries
+	}
+	entries := make([]protocol.RaftEntry, end-(prev+1))
+	copy(entries, r.rlog[prev+1:end])
+
+	r.send(peer, protocol.RaftMessage{
+		Type:         "appendEntries",
+		Term:         r.term,
+		PrevLogIndex: prev,
+		PrevLogTerm:  r.rlog[prev].Term,
+		Entries:      entries,
+		LeaderCommit: r.commitIndex,
+	})
+}
+
+// commits the newest entry of the current term stored on a majority
+// callers hold r.mu
+func (r *raftNode) advanceCommit() {
+	// the leader counts itself, its entries must be saved
+	r.persist()
+	for n := r.lastIndex(); n > r.commitIndex; n-- {
+		if r.rlog[n].Term != r.term {
+			break
+		}
+		count := 1
+		for _, peer := range r.peers {
+			if r.matchIndex[peer] >= n {
+				count++
+			}
+		}
+		if count*2 > len(r.peers)+1 {
+			r.commitIndex = n
+			r.apply()
+			return
+		}
+	}
+}
+
+// applies committed entries to the store in log order
+// callers hold r.mu
+func (r *raftNode) apply() {
+	for r.lastApplied < r.commitIndex {
+		r.lastApplied++
+		entry := r.rlog[r.lastApplied]
+
+		// keys expired before this entry are deleted before it on every server
+		for _, key := range r.expiry.Due(entry.Timestamp) {
+			r.kvStore.Delete(key)
+		}
+
+		req := &entry.Request
+		res := raftResult{reply: &protocol.Reply{}}
+		if req.Op == "set" {
+			stored, err := r.kvStore.Set(req.Key, req.Value)
+			if err != nil {
+				res.err = err
+			}
+			res.reply.Version = stored.Version
+			if req.TTL > 0 {
+				r.expiry.Set(req.Key, entry.Timestamp + req.TTL)
+			} else {
+				r.expiry.Clear(req.Key)
+			}
+		} else if req.Op == "del" {
+			if err := r.kvStore.Delete(req.Key); err != nil {
+				res.err = err
+			}
+			r.expiry.Clear(req.Key)
+		} else if req.Op == "ttl" {
+			res.reply.TTL = remainingTTL(r.kvStore, r.expiry, req.Key, entry.Timestamp)
+		} else if req.Op == "persist" {
+			res.reply.Persisted = r.expiry.Clear(req.Key)
+		} else if req.Op == "scan" {
+			page, err := scanStore(r.kvStore, parseScan(req))
+			if err != nil {
+				res.err = err
+			}
+			res.reply = pageReply(page)
+		} else if req.Op == "get" {
+			stored, err := r.kvStore.Get(req.Key)
+			if err != nil && err != u.ErrNotFound {
+				res.err = err
+			}
+			res.reply.Value = stored.Value
+			res.reply.Version = stored.Version
+		}
+
+		if w, ok := r.waiters[r.lastApplied]; ok {
+			delete(r.waiters, r.lastApplied)
+			if w.id != entry.Id {
+				// our entry was replaced by a newer leader
+				res = raftResult{err: errNotLeader}
+			}
+			w.ch <- res
+		}
+	}
+}
+
+// saves term, vote and log, nothing leaves the node before they are saved
+// callers hold r.mu
+func (r *raftNode) persist() {
+	if r.closed {
+		return
+	}
+	if err := r.storage.save(raftState{Term: r.term, VotedFor: r.votedFor}, r.rlog); err != nil {
+		log.Fatalf("Raft state of %s can not be saved: %v\n", r.self, err)
+	}
+}
+
+// callers hold r.mu
+func (r *raftNode) send(to string, msg protocol.RaftMessage) {
+	r.persist()
+	msg.From = r.self
+	raw, _ := json.Marshal(msg)
+	if err := r.transport.Send(to, raw); err != nil && err != ErrTransportClosed {
+		log.Printf("Raft message from %s to %s failed: %v\n", r.self, to, err)
+	}
+}
+
+func (r *raftNode) lastIndex() int {
+	return len(r.rlog) - 1
+}
+
+// timestamp of a new entry, the wall clock unless an earlier entry,
+// maybe of another leader, is ahead of it
+// callers hold r.mu
+func (r *raftNode) timestamp() int64 {
+	now := time.Now().UnixMilli()
+	if last := r.rlog[r.lastIndex()].Timestamp; last > now {
+		return last
+	}
+	return now
+}
+
+func (r *raftNode) resetElectionTimeout() {
+	spread := int64(electionTimeoutMax - electionTimeoutMin)
+	r.electionTimeout = electionTimeoutMin + time.Duration(r.rand.Int63n(spread))
+}
@@ -0,0 +1,189 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"dist-kv/protocol"
+	u "dist-kv/utils"
+)
+
+const (
+	raftStateFile = "state.json"
+	raftLogFile   = "log.jsonl"
+)
+
+// term and vote of a server, they must survive a restart
+type raftState struct {
+	Term     int64  `json:"term"`
+	VotedFor string `json:"votedFor"`
+}
+
+/*
+	Durable raft state of one server
+	- term and vote are rewritten whole, the log is appended one entry per line
+	- a node saves before any message leaves it, so a restarted node never
+	  votes twice in a term or forgets entries it acknowledged
+	- entries with the same index and term are the same entry, so a log
+	  that diverged from the saved one is found by comparing terms and rewritten
+	- a torn last line is dropped on open
+*/
+type raftStorage struct {
+	dir   string
+	sync  bool
+	state raftState
+	terms []int64 // term of every saved entry, terms[0] is the sentinel
+	file  *os.File
+}
+
+// the directory holding the raft state of the server
+func raftDir(serverIface string) string {
+	return u.Config.DataPath("raft-" + serverIface)
+}
+
+// drops the raft state of the server, it starts over with an empty log
+func RemoveRaftState(serverIface string) error {
+	return os.RemoveAll(raftDir(serverIface))
+}
+
+// opens the storage in dir and returns the state and log saved there
+func openRaftStorage(dir string, fsync string) (*raftStorage, raftState, []protocol.RaftEntry, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, raftState{}, nil, err
+	}
+	s := &raftStorage{dir: dir, sync: fsync != u.FsyncNever, terms: []int64{0}}
+
+	raw, err := os.ReadFile(filepath.Join(dir, raftStateFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, raftState{}, nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(raw, &s.state); err != nil {
+			return nil, raftState{}, nil, err
+		}
+	}
+
+	rlog := []protocol.RaftEntry{{}}
+	if file, err := os.Open(filepath.Join(dir, raftLogFile)); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 64<<20)
+		for scanner.Scan() {
+			entry := protocol.RaftEntry{}
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				// a write cut short by a crash
+				break
+			}
+			rlog = append(rlog, entry)
+		}
+		file.Close()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, raftState{}, nil, err
+	}
+
+	// rewriting drops a torn line and opens the file for appending
+	if err := s.rewrite(rlog); err != nil {
+		return nil, raftState{}, nil, err
+	}
+	return s, s.state, rlog, nil
+}
+
+// saves whatever changed since the last save
+func (s *raftStorage) save(state raftState, rlog []protocol.RaftEntry) error {
+	if state != s.state {
+		raw, _ := json.Marshal(state)
+		if err := s.replace(raftStateFile, raw); err != nil {
+			return err
+		}
+		s.state = state
+	}
+
+	saved := len(s.terms) - 1
+	common := saved
+	if len(rlog)-1 < common {
+		common = len(rlog) - 1
+	}
+	if common < saved || rlog[common].Term != s.terms[common] {
+		// entries were dropped or replaced
+		return s.rewrite(rlog)
+	}
+	if len(rlog)-1 == saved {
+		return nil
+	}
+
+	writer := bufio.NewWriter(s.file)
+	for _, entry := range rlog[saved+1:] {
+		raw, _ := json.Marshal(entry)
+		writer.Write(raw)
+		writer.WriteByte('\n')
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if s.sync {
+		if err := s.file.Sync(); err != nil {
+			return err
+		}
+	}
+	for _, entry := range rlog[saved+1:] {
+		s.terms = append(s.terms, entry.Term)
+	}
+	return nil
+}
+
+func (s *raftStorage) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// replaces the saved log with the given one
+func (s *raftStorage) rewrite(rlog []protocol.RaftEntry) error {
+	var lines []byte
+	terms := []int64{0}
+	for _, entry := range rlog[1:] {
+		raw, _ := json.Marshal(entry)
+		lines = append(append(lines, raw...), '\n')
+		terms = append(terms, entry.Term)
+	}
+	if err := s.replace(raftLogFile, lines); err != nil {
+		return err
+	}
+
+	s.Close()
+	file, err := os.OpenFile(filepath.Join(s.dir, raftLogFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.file = file
+	s.terms = terms
+	return nil
+}
+
+// writes the file through a temporary one, a crash leaves the old or the new one
+func (s *raftStorage) replace(name string, raw []byte) error {
+	path := filepath.Join(s.dir, name)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if s.sync {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
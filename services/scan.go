@@ -0,0 +1,93 @@
+package services
+
+import (
+	"dist-kv/protocol"
+	u "dist-kv/utils"
+)
+
+// page size of a scan without a limit, and the largest page served
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+// a page of a scan
+type scanPage struct {
+	Entries []u.Entry
+	Cursor  string
+}
+
+// key range and page size of a scan request
+// format {op: 'scan', start: key, end: key, prefix: prefix, limit: n, cursor: cursor}
+type scanRange struct {
+	start string
+	end   string
+	limit int
+}
+
+// reads the range of a scan request
+// a prefix narrows the range to the keys starting with it
+// a cursor from an earlier page resumes after the last key of that page
+func parseScan(message *protocol.Request) scanRange {
+	r := scanRange{start: message.Start, end: message.End, limit: defaultScanLimit}
+	if prefix := message.Prefix; prefix != "" {
+		if prefix > r.start {
+			r.start = prefix
+		}
+		if end := prefixEnd(prefix); end != "" && (r.end == "" || end < r.end) {
+			r.end = end
+		}
+	}
+	if cursor := message.Cursor; cursor != "" && cursor >= r.start {
+		// the smallest key after the cursor
+		r.start = cursor + "\x00"
+	}
+	if message.Limit > 0 {
+		r.limit = message.Limit
+	}
+	if r.limit > maxScanLimit {
+		r.limit = maxScanLimit
+	}
+	return r
+}
+
+// the first key after every key with the prefix, empty if there is none
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// scans one page of the store
+func scanStore(kvStore u.Store, r scanRange) (scanPage, error) {
+	// one extra entry tells if there is another page
+	entries, err := kvStore.Scan(r.start, r.end, r.limit + 1)
+	if err != nil {
+		return scanPage{}, err
+	}
+
+	page := scanPage{Entries: entries}
+	if len(entries) > r.limit {
+		page.Entries = entries[:r.limit]
+		page.Cursor = page.Entries[r.limit - 1].Key
+	}
+	return page, nil
+}
+
+// scans one page of the store into a reply
+func serveScan(kvStore u.Store, message *protocol.Request) *protocol.Reply {
+	page, err := scanStore(kvStore, parseScan(message))
+	if err != nil {
+		return failed(storeError(err))
+	}
+	return pageReply(page)
+}
+
+func pageReply(page scanPage) *protocol.Reply {
+	return &protocol.Reply{Entries: page.Entries, Cursor: page.Cursor}
+}
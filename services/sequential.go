@@ -4,196 +4,356 @@ import (
 	"container/heap"
 	"context"
 	"encoding/json"
-	"fmt"
 	"log"
 	"math/rand"
-	"net"
-	"strconv"
 	"strings"
 	"sync"
-	"time"
 
+	"dist-kv/protocol"
 	u "dist-kv/utils"
-
-	"github.com/redis/go-redis/v9"
 )
 
 /*
-	- Total order broadcast for writes
-	- Local read implementation
-	- Logical sequences for writes for partial order
+	- Total order broadcast for writes and batch reads
+	- Local read implementation for single keys and scans
+	- Hybrid logical clocks for writes for partial order
 	- Total order is acheived process ids
 */
 func StartSequentialServer(clientIface, serverIface, kvStoreIface string) error {
-	// config accessor
-	cfg := u.Config
 	ctx := context.Background()
 
-	kvStore, err := u.StartRedisClient(ctx, kvStoreIface)
+	kvStore, err := u.StartStore(ctx, kvStoreIface)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// changes applied to the store are streamed to watchers
+	hub := newWatchHub()
+	kvStore = hub.watch(kvStore)
 
 	// fmt.Printf("Server listeneing on ports: %s | %s\n", clientIface, serverIface)
-	listener, _ := net.Listen(cfg.NetType, cfg.NetAddr + ":" + clientIface)
-	intListener, _ := net.Listen(cfg.NetType, cfg.NetAddr + ":" + serverIface) // internal listener
+	listener, err := listen(clientIface, serverIface)
+	if err != nil {
+		return err
+	}
+	intListener, err := listen(serverIface, serverIface) // internal listener
+	if err != nil {
+		return err
+	}
+	transport := NewTransport(serverIface)
+
+	handleRequest, handlePeer := newSequential(clientIface, serverIface, kvStore, transport, realClock{}, newRand())
+	go servePeers(intListener, handlePeer)
+
+	// handle connections until the server is killed
+	return serveClients(listener, handleRequest, hub)
+}
+
+// handlers of the sequential protocol over the given store, message bus and clock
+func newSequential(clientIface, serverIface string, kvStore u.Store, bus Bus, clock Clock, r *rand.Rand) (requestHandler, peerHandler) {
+	// config accessor
+	cfg := u.Config
+	// ids of the messages this server sends
+	nextId := newIds(serverIface, r)
 
 	var mu sync.Mutex
 	// tracks message id and ack count
-	logicalTimestamp := 0
+	hlc := newHLC(clock)
 	acks := map[string]int{}
-	connQ := make(chan net.Conn, 1000)
-	pq := make(u.PriorityQueue, 0)
+	// replies to the persist and mget requests of this server, by message id
+	// only requests still waiting for their reply get one
+	outcomes := map[string]*protocol.Reply{}
+	waiting := map[string]bool{}
+	// keys expire at the ordering timestamp of their write plus the ttl
+	// they are deleted at delivered points of the total order only, a read
+	// finding a key due on the local clock orders an expire first
+	expiry := u.NewExpirations()
+	pq := make(u.PriorityQueue[*protocol.Peer], 0)
 	heap.Init(&pq)
 
-	// register connection handler for server-to-server broadcasts 
-	go func() {
-		for {
-			conn, _ := intListener.Accept()
-			buffer := make([]byte, cfg.PayloadSize)
-			size, _ := conn.Read(buffer)
+	// applies a write delivered at its point of the total order
+	// callers hold mu
+	deliver := func(message *protocol.Peer) {
+		ts := message.Timestamp
+		req := &message.Request
+		forExpired(expiry, ts.Wall, func(key string, at u.Timestamp) {
+			applyAt(kvStore, at, "", u.Write{Key: key, Delete: true})
+		})
 
-			message := map[string]string{}
-			json.Unmarshal(buffer[:size], &message)
-			message["op"] = strings.ToLower(message["op"])
+		switch req.Op {
+		case "set":
+			// a mixed server skips a write a later one of another level overtook
+			if applied, _ := applyAt(kvStore, ts, message.Origin, u.Write{Key: req.Key, Value: req.Value}); !applied {
+				break
+			}
+			if req.TTL > 0 {
+				expiry.Set(req.Key, ts.Wall + req.TTL)
+			} else {
+				expiry.Clear(req.Key)
+			}
+		case "del":
+			if applied, _ := applyAt(kvStore, ts, message.Origin, u.Write{Key: req.Key, Delete: true}); applied {
+				expiry.Clear(req.Key)
+			}
+		case "mset":
+			writes, _ := parseValues(req)
+			for _, w := range writes {
+				if applied, _ := applyAt(kvStore, ts, message.Origin, w); applied {
+					expiry.Clear(w.Key)
+				}
+			}
+		case "persist":
+			persisted := expiry.Clear(req.Key)
+			if waiting[message.Id] {
+				outcomes[message.Id] = &protocol.Reply{Persisted: persisted}
+			}
+		case "mget":
+			// read at one point of the order, never between the writes of a batch
+			if waiting[message.Id] {
+				keys, _ := parseKeys(req)
+				outcomes[message.Id] = serveBatch(kvStore, keys)
+			}
+		} // an expire only deletes the keys due at its timestamp
+	}
+
+	// handler for server-to-server broadcasts
+	// messages from one peer are handled in the order they were sent
+	handlePeer := func(message *protocol.Peer) {
+		message.Request.Op = strings.ToLower(message.Request.Op)
+
+		// every received message moves the clock past its timestamp
+		hlc.Update(message.Timestamp)
 
-			ts, _ := strconv.Atoi(strings.Split(message["totalOrderTimestamp"], ".")[0])
+		// fmt.Printf("At %s received {%s: %v}\n", serverIface, message.Request.Op, message.Timestamp)
+		// message is acknowledgement
+		if message.Ack {
 			mu.Lock()
-			if ts > logicalTimestamp { logicalTimestamp = ts }
-			logicalTimestamp++
-			mu.Unlock()
+			_, ok := acks[message.Id]
+			if ok {
+				acks[message.Id]++
+			} else {
+				acks[message.Id] = 1
+			}
+
+			// whenever we got an ack, we check whether the message is deliverable
+			for pq.Len() > 0 {
+				head := heap.Pop(&pq).(*u.Item[*protocol.Peer])
+				// received all the acks for the head
+				if acks[head.Message.Id] == cfg.NumServers {
+					// only write messages are broadcasted!
+					deliver(head.Message)
 
-			_, isAck := message["ack"]
-			// fmt.Printf("At %s received {%s: %s}\n", serverIface, message["op"], message["totalOrderTimestamp"])
-			// message is acknowledgement
-			if isAck {
-				mu.Lock()
-				_, ok := acks[message["id"]]
-				if ok {
-					acks[message["id"]]++
+					// assuming we don't get acks after we receive all acks
+					acks[head.Message.Id] = -1
+					// fmt.Printf("%v\n", acks)
+					// fmt.Printf("PQ len %d\n", pq.Len())
 				} else {
-					acks[message["id"]] = 1
+					heap.Push(&pq, head)
+					break
 				}
+			}
 
-				// whenever we got an ack, we check whether the message is deliverable
-				for pq.Len() > 0 {
-					head := heap.Pop(&pq).(*u.Item)
-					// received all the acks for the head
-					if acks[head.Message["id"]] == cfg.NumServers {
-						// only write messages are broadcasted!
-						kvStore.Set(ctx, head.Message["key"], head.Message["value"], 0)
-
-						// assuming we don't get acks after we receive all acks
-						acks[head.Message["id"]] = -1
-						// fmt.Printf("%v\n", acks)
-						// fmt.Printf("PQ len %d\n", pq.Len())
-					} else {
-						heap.Push(&pq, head)
-						break
-					}
-				}
+			mu.Unlock()
+			// spawn a go routine if all acks are all received
 
-				mu.Unlock()
-				// spawn a go routine if all acks are all received
-
-			} else if message["op"] == "set" {
-				// Generating total order based on process id
-				// strips the unix timestamp for testing
-				totOrderTimestamp := message["totalOrderTimestamp"]
-				timestamp, _ := strconv.ParseFloat(totOrderTimestamp, 64)
-
-				mu.Lock()
-				heap.Push(&pq, &u.Item{
-					Message: message,
-					Priority: timestamp,
-				})
-				top := heap.Pop(&pq).(*u.Item)
-				// fmt.Printf("Top at PQ on %s is {%s: %f}\n", serverIface, top.Message["op"], top.Priority)
-				heap.Push(&pq, top)
-				mu.Unlock()
-
-				// serialize message
-				message["ack"] = "ok"
-				jsonMsg, _ := json.Marshal(message)
-
-				// broadcast ack to all the other servers including itself!
-				BroadcastMsg(jsonMsg, serverIface, true, 1)
-			}
-			conn.Close()
-		}
-	}()
+		} else if isSequentialOrdered(message.Request.Op) || message.Request.Op == "expire" {
+			// Generating total order based on the hybrid timestamp
+			// ties are broken by the originating server
+			mu.Lock()
+			heap.Push(&pq, &u.Item[*protocol.Peer]{
+				Message: message,
+				Timestamp: message.Timestamp,
+				Node: message.Origin,
+			})
+			top := heap.Pop(&pq).(*u.Item[*protocol.Peer])
+			// fmt.Printf("Top at PQ on %s is {%s: %v}\n", serverIface, top.Message.Request.Op, top.Timestamp)
+			heap.Push(&pq, top)
+			mu.Unlock()
 
-	// connection handler for client-to-server messages
-	go func() {
-		for conn := range connQ {
-			// handle connection here
-			buffer := make([]byte, cfg.PayloadSize)
-			size, _ := conn.Read(buffer)
+			// serialize the ack, the queued message stays as it is
+			ackMsg := *message
+			ackMsg.Ack = true
+			jsonMsg, _ := json.Marshal(ackMsg)
 
+			// broadcast ack to all the other servers including itself!
+			if err := bus.Broadcast(jsonMsg, true); err != nil {
+				log.Printf("Broadcast from %s failed: %v\n", serverIface, err)
+			}
+		}
+	}
+
+	// puts the request into the total order at the given timestamp,
+	// waits until it is delivered on this server and returns its outcome
+	order := func(message *protocol.Request, seq u.Timestamp) (*protocol.Reply, *protocol.Error) {
+		broadcast := &protocol.Peer{
+			Request: *message,
+			// add unique message id
+			Id: nextId(),
+			Origin: serverIface,
+			Timestamp: seq,
+		}
+		mu.Lock()
+		waiting[broadcast.Id] = true
+		mu.Unlock()
+		// a request that gave up leaves no outcome behind
+		defer func() {
 			mu.Lock()
-			logicalTimestamp++ // increases sequence for request
+			delete(waiting, broadcast.Id)
+			delete(outcomes, broadcast.Id)
 			mu.Unlock()
+		}()
 
-			// format {op: 'set', key: key, value: value}
-			// format {op: 'get', key: key}
-			message := make(map[string]string)
-			json.Unmarshal(buffer[:size], &message)
+		msgBytes, _ := json.Marshal(broadcast)
+		if err := bus.Broadcast(msgBytes, true); err != nil {
+			log.Printf("Broadcast from %s failed: %v\n", serverIface, err)
+			return nil, protocol.Wrap(protocol.Unavailable, err)
+		}
 
-			message["op"] = strings.ToLower(message["op"])
-			// add unique message id
-			message["id"] = strconv.Itoa(rand.Int())
-			// add timestamp to the request
-			timestamp := time.Now().UnixMilli()
-			message["timestamp"] = strconv.FormatInt(timestamp, 10)
-
-			// Both read and write are blocking operations
-			if message["op"] == "set" {
-				message["totalOrderTimestamp"] = fmt.Sprintf("%d.%s", logicalTimestamp, serverIface)
-				msgBytes, _ := json.Marshal(message)
-				BroadcastMsg(msgBytes, serverIface, true, 1)
-				log.Printf("%d Start : Write %s = %s at server %s\n", logicalTimestamp, message["key"], message["value"], clientIface)
-
-				// commit the message here
-				for {
-					time.Sleep(time.Millisecond * 10)
-					mu.Lock()
-					ackCount, ok := acks[message["id"]]
-					// fmt.Printf("Ack count for  %d\n", ackCount)
-					mu.Unlock()
-					// when all acks are received, before updating the last ack
-					// separate thread updates the database based on the priority queue
-					if ok && (ackCount == -1) { break }
-				}
+		delivered := awaitDelivery(clock, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			// when all acks are received, before updating the last ack
+			// separate thread updates the database based on the priority queue
+			return acks[broadcast.Id] == -1
+		})
+		if !delivered {
+			log.Printf("%v Fail  : %s at server %s: %v\n", seq, message.Op, clientIface, errOrderTimeout)
+			return nil, replicaError(bus, cfg.ServerPorts[:cfg.NumServers], errOrderTimeout)
+		}
 
-				message["errors"] = ""
-				log.Printf("%d End   : Write %s = %s at server %s\n", logicalTimestamp, message["key"], message["value"], clientIface)
+		mu.Lock()
+		defer mu.Unlock()
+		if outcome, ok := outcomes[broadcast.Id]; ok {
+			return outcome, nil
+		}
+		return &protocol.Reply{}, nil
+	}
 
-			} else if message["op"] == "get" {
-				log.Printf("%d Start : Read %s at server %s\n", logicalTimestamp, message["key"], clientIface)
+	// orders an expire before a read once a key is due on the local clock
+	// replicas delete the due keys where the expire is delivered, so they
+	// agree on which writes a key outlived
+	expireDue := func(message *protocol.Request, seq u.Timestamp) *protocol.Error {
+		mu.Lock()
+		at, ok := expiry.Next()
+		mu.Unlock()
+		if !ok || at > seq.Wall {
+			return nil
+		}
+		_, err := order(&protocol.Request{Op: "expire", Consistency: message.Consistency}, hlc.Now())
+		return err
+	}
 
-				mu.Lock()
-				val, err := kvStore.Get(ctx, message["key"]).Result()
-				mu.Unlock()
-				if err == redis.Nil {
-					message["value"] = "nil"
-				} else {
-					message["value"] = val
-				}
+	// handler for client-to-server requests
+	// requests sharing a connection are served concurrently
+	handleRequest := func(message *protocol.Request) *protocol.Reply {
+		// increases sequence for request
+		seq := hlc.Now()
+
+		// format {op: 'set', key: key, value: value, ttl: milliseconds}
+		// format {op: 'get', key: key}
+		// format {op: 'del', key: key}
+		// format {op: 'mset', values: {key: value}}
+		// format {op: 'mget', keys: [key]}
+		// format {op: 'ttl', key: key}
+		// format {op: 'persist', key: key}
+		// format {op: 'scan', start: key, end: key, prefix: prefix, limit: n, cursor: cursor}
+		message.Op = strings.ToLower(message.Op)
+
+		// Both read and write are blocking operations
+		if message.Op == "mset" {
+			if _, bad := parseValues(message); bad != nil {
+				return failed(bad)
+			}
+		} else if message.Op == "mget" {
+			if _, bad := parseKeys(message); bad != nil {
+				return failed(bad)
+			}
+		}
 
-				log.Printf("%d End   : Read %s = %s at server %s\n", logicalTimestamp, message["key"], message["value"], clientIface)
+		// reads are local, the keys due on this server are deleted first
+		switch message.Op {
+		case "get", "scan", "ttl":
+			if err := expireDue(message, seq); err != nil {
+				return failed(err)
+			}
+		}
+
+		reply := &protocol.Reply{}
+		if isSequentialOrdered(message.Op) {
+			if message.Op == "set" {
+				log.Printf("%v Start : Write %s = %s at server %s\n", seq, message.Key, message.Value, clientIface)
+			} else if message.Op == "del" {
+				log.Printf("%v Start : Delete %s at server %s\n", seq, message.Key, clientIface)
+			} else if message.Op == "mset" {
+				log.Printf("%v Start : Write %v at server %s\n", seq, message.Values, clientIface)
+			} else if message.Op == "mget" {
+				log.Printf("%v Start : Read %v at server %s\n", seq, message.Keys, clientIface)
 			} else {
-				message["error"] = "Client Error!"
+				log.Printf("%v Start : Persist %s at server %s\n", seq, message.Key, clientIface)
 			}
 
-			res, _ := json.Marshal(message)
-			conn.Write(res)
-			conn.Close()
+			// commit the message here
+			outcome, err := order(message, seq)
+			if err != nil {
+				return failed(err)
+			}
+			reply = outcome
+
+			if message.Op == "set" {
+				log.Printf("%v End   : Write %s = %s at server %s\n", seq, message.Key, message.Value, clientIface)
+			} else if message.Op == "del" {
+				log.Printf("%v End   : Delete %s at server %s\n", seq, message.Key, clientIface)
+			} else if message.Op == "mset" {
+				log.Printf("%v End   : Write %v at server %s\n", seq, message.Values, clientIface)
+			} else if message.Op == "mget" {
+				log.Printf("%v End   : Read %v = %v at server %s\n", seq, message.Keys, reply.Values, clientIface)
+			} else {
+				log.Printf("%v End   : Persist %s persisted %t at server %s\n", seq, message.Key, reply.Persisted, clientIface)
+			}
+
+		} else if message.Op == "scan" {
+			// scans are local like reads
+			log.Printf("%v Start : Scan [%s, %s) at server %s\n", seq, message.Start, message.End, clientIface)
+
+			mu.Lock()
+			page, err := scanStore(kvStore, parseScan(message))
+			mu.Unlock()
+			if err != nil {
+				return failed(storeError(err))
+			}
+			reply = pageReply(page)
+
+			log.Printf("%v End   : Scan [%s, %s) cursor %s at server %s\n", seq, message.Start, message.End, reply.Cursor, clientIface)
+		} else if message.Op == "get" {
+			log.Printf("%v Start : Read %s at server %s\n", seq, message.Key, clientIface)
+
+			mu.Lock()
+			entry, err := kvStore.Get(message.Key)
+			mu.Unlock()
+			if err == u.ErrNotFound {
+				reply.Value = "nil"
+			} else {
+				reply.Value = entry.Value
+				reply.Version = entry.Version
+			}
+
+			log.Printf("%v End   : Read %s = %s at server %s\n", seq, message.Key, reply.Value, clientIface)
+		} else if message.Op == "ttl" {
+			// local like reads
+			mu.Lock()
+			reply.TTL = remainingTTL(kvStore, expiry, message.Key, seq.Wall)
+			mu.Unlock()
+			log.Printf("%v Ttl of %s is %d at server %s\n", seq, message.Key, reply.TTL, clientIface)
+		} else {
+			return failed(clientError(message.Op))
 		}
-	}()
 
-	// handle connections
-	for {
-		conn, _ := listener.Accept()
-		connQ <- conn
+		return reply
 	}
-}
\ No newline at end of file
+
+	return handleRequest, handlePeer
+}
+
+// writes and batch reads go through the total order, the other reads are local
+func isSequentialOrdered(op string) bool {
+	return op == "set" || op == "del" || op == "mset" || op == "persist" || op == "mget"
+}
@@ -0,0 +1,331 @@
+package services
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dist-kv/protocol"
+	u "dist-kv/utils"
+)
+
+// Clock is the time source of a protocol
+// servers run on the real clock, simulations on a virtual one
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// Bus carries messages between the servers of a cluster
+// servers use a Transport, simulations deliver the messages themselves
+// send errors mean the message was not queued, LastError reports a peer
+// the queued messages can not be delivered to
+type Bus interface {
+	Send(to string, message []byte) error
+	Broadcast(message []byte, self bool) error
+	LastError(to string) error
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// an HLC reading physical time from the clock
+func newHLC(clock Clock) *u.HLC {
+	return u.NewHLCWithClock(func() int64 { return clock.Now().UnixMilli() })
+}
+
+// a rand seeded from the real clock, for servers outside of a simulation
+func newRand() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+// draws the ids of the messages and requests one server sends from r
+// ids start with the server, servers seeded alike never share one
+func newIds(serverIface string, r *rand.Rand) func() string {
+	var mu sync.Mutex
+	return func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return serverIface + "-" + strconv.Itoa(r.Int())
+	}
+}
+
+// protocols a simulation can run, by consistency level
+var simProtocols = map[string]func(string, string, u.Store, Bus, Clock, *rand.Rand) (requestHandler, peerHandler){
+	LinearizableLevel: newLinearizable,
+	SequentialLevel:   newSequential,
+	EventualLevel:     newEventual,
+	CausalLevel:       newCausal,
+}
+
+// virtual time zero of every simulation
+var simEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+/*
+	Simulation runs a whole cluster of one protocol on a virtual clock
+	- there is no real network or time, messages go through a simulated
+	  bus and sleeping moves a request to a later point of the virtual clock
+	- one step runs at a time: a message handler, or a request until it
+	  sleeps or returns, so a run is a single sequence of steps
+	- message latencies come from the seeded random source, different
+	  seeds explore different interleavings and a seed replays its run exactly
+	- messages on a link arrive in the order they were sent, as on a Transport
+	- the cluster has the servers of the config, each with a memory store
+*/
+type Simulation struct {
+	Seed int64
+	// latencies of messages are drawn between these
+	MinLatency time.Duration
+	MaxLatency time.Duration
+	// percent of peer messages delivered twice, the copy right after the message
+	Duplicate int
+
+	rand     *rand.Rand
+	now      time.Duration
+	events   simEvents
+	seq      int
+	servers  []*simServer
+	arrivals map[string]time.Duration // last arrival on every link
+	trace    []string
+
+	// the request running now, it hands control back on yield
+	running *simTask
+	yield   chan struct{}
+}
+
+type simServer struct {
+	port          string
+	store         u.Store
+	handleRequest requestHandler
+	handlePeer    peerHandler
+}
+
+// a request running as its own goroutine, one step at a time
+type simTask struct {
+	resume chan struct{}
+}
+
+// builds a cluster running the protocol of the consistency level
+func NewSimulation(level string, seed int64) (*Simulation, error) {
+	newProtocol, ok := simProtocols[strings.ToLower(level)]
+	if !ok {
+		return nil, fmt.Errorf("no simulation of consistency level: %s", level)
+	}
+
+	s := &Simulation{
+		Seed:       seed,
+		MinLatency: time.Millisecond,
+		MaxLatency: 20 * time.Millisecond,
+		rand:       rand.New(rand.NewSource(seed)),
+		arrivals:   map[string]time.Duration{},
+		yield:      make(chan struct{}),
+	}
+	cfg := u.Config
+	for i := 0; i < cfg.NumServers; i++ {
+		port := cfg.ServerPorts[i]
+		store := u.NewMemoryStore()
+		// every server draws its ids from a rand of its own, seeded by the simulation
+		handleRequest, handlePeer := newProtocol(cfg.ClientPorts[i], port, store, simBus{s, port}, simClock{s}, rand.New(rand.NewSource(s.rand.Int63())))
+		s.servers = append(s.servers, &simServer{port, store, handleRequest, handlePeer})
+	}
+	return s, nil
+}
+
+// sends the request to the i-th server at the given virtual time
+// done gets the reply, it may send further requests
+func (s *Simulation) Request(at time.Duration, server int, req *protocol.Request, done func(*protocol.Reply)) {
+	target := s.servers[server]
+	s.schedule(at, func() {
+		s.record("request %s %s %s=%s at %s", req.Op, req.Consistency, req.Key, req.Value, target.port)
+		s.spawn(func() {
+			reply := target.handleRequest(req)
+			replyJSON, _ := json.Marshal(reply)
+			s.record("reply %s at %s %s", req.Op, target.port, replyJSON)
+			if done != nil {
+				done(reply)
+			}
+		})
+	})
+}
+
+// runs steps in order until none is left or the clock reaches until
+// false if steps were left, a request may be stuck
+func (s *Simulation) Run(until time.Duration) bool {
+	for s.events.Len() > 0 {
+		next := heap.Pop(&s.events).(*simEvent)
+		if next.at > until {
+			heap.Push(&s.events, next)
+			s.now = until
+			return false
+		}
+		s.now = next.at
+		next.run()
+	}
+	return true
+}
+
+// virtual time since the start of the simulation
+func (s *Simulation) Now() time.Duration {
+	return s.now
+}
+
+// the store of the i-th server
+func (s *Simulation) Store(i int) u.Store {
+	return s.servers[i].store
+}
+
+// every step taken so far, the same seed gives the same trace
+func (s *Simulation) Trace() []string {
+	return append([]string{}, s.trace...)
+}
+
+func (s *Simulation) record(format string, args ...any) {
+	s.trace = append(s.trace, fmt.Sprintf("%v ", s.now)+fmt.Sprintf(format, args...))
+}
+
+func (s *Simulation) schedule(at time.Duration, run func()) {
+	s.seq++
+	heap.Push(&s.events, &simEvent{at: at, seq: s.seq, run: run})
+}
+
+// starts f as a task and waits until it sleeps or returns
+func (s *Simulation) spawn(f func()) {
+	task := &simTask{resume: make(chan struct{})}
+	go func() {
+		<-task.resume
+		f()
+		s.yield <- struct{}{}
+	}()
+	s.step(task)
+}
+
+// lets the task run until it sleeps or returns
+func (s *Simulation) step(task *simTask) {
+	s.running = task
+	task.resume <- struct{}{}
+	<-s.yield
+	s.running = nil
+}
+
+// a step of the simulation, steps at the same time run in the order they were scheduled
+type simEvent struct {
+	at  time.Duration
+	seq int
+	run func()
+}
+
+type simEvents []*simEvent
+
+func (e simEvents) Len() int { return len(e) }
+func (e simEvents) Less(i, j int) bool {
+	if e[i].at != e[j].at {
+		return e[i].at < e[j].at
+	}
+	return e[i].seq < e[j].seq
+}
+func (e simEvents) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+
+func (e *simEvents) Push(x any) {
+	*e = append(*e, x.(*simEvent))
+}
+
+func (e *simEvents) Pop() any {
+	old := *e
+	n := len(old)
+	item := old[n-1]
+	*e = old[:n-1]
+	return item
+}
+
+// the virtual clock, only requests sleep, message handlers never do
+type simClock struct {
+	sim *Simulation
+}
+
+func (c simClock) Now() time.Time {
+	return simEpoch.Add(c.sim.now)
+}
+
+// parks the running request and wakes it up d later
+func (c simClock) Sleep(d time.Duration) {
+	s := c.sim
+	task := s.running
+	if task == nil {
+		panic("simulation: sleep outside of a request")
+	}
+	s.schedule(s.now + d, func() { s.step(task) })
+	s.yield <- struct{}{}
+	<-task.resume
+}
+
+// the bus of one server of the simulation
+type simBus struct {
+	sim  *Simulation
+	from string
+}
+
+func (b simBus) Send(to string, message []byte) error {
+	s := b.sim
+	var target *simServer
+	for _, server := range s.servers {
+		if server.port == to {
+			target = server
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("no server %s in the simulation", to)
+	}
+
+	// a message never overtakes an earlier one on its link
+	at := s.now + s.MinLatency
+	if spread := int64(s.MaxLatency - s.MinLatency); spread > 0 {
+		at += time.Duration(s.rand.Int63n(spread))
+	}
+	link := b.from + ">" + to
+	if at < s.arrivals[link] {
+		at = s.arrivals[link]
+	}
+	s.arrivals[link] = at
+
+	payload := append([]byte{}, message...)
+	deliver := func() {
+		message := &protocol.Peer{}
+		json.Unmarshal(payload, message)
+		s.record("deliver %s %s %s=%s ack %t from %s to %s", message.Id, message.Request.Op, message.Request.Key, message.Request.Value, message.Ack, b.from, to)
+		target.handlePeer(message)
+	}
+	s.schedule(at, deliver)
+	if s.Duplicate > 0 && s.rand.Intn(100) < s.Duplicate {
+		s.schedule(at, deliver)
+	}
+	return nil
+}
+
+// the simulated network never fails
+func (b simBus) LastError(to string) error {
+	return nil
+}
+
+func (b simBus) Broadcast(message []byte, self bool) error {
+	for _, server := range b.sim.servers {
+		if !self && server.port == b.from {
+			continue
+		}
+		if err := b.Send(server.port, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	u "dist-kv/utils"
+)
+
+const (
+	// messages buffered per peer while it is slow or down
+	peerQueueSize = 10000
+	minBackoff    = 10 * time.Millisecond
+	maxBackoff    = 2 * time.Second
+)
+
+var (
+	ErrQueueFull       = errors.New("peer queue is full")
+	ErrTransportClosed = errors.New("transport is closed")
+)
+
+/*
+Transport keeps one ordered long lived connection per peer
+  - messages to a peer are delivered in the order they were sent
+  - a peer that is down is redialed with exponential backoff,
+    its messages wait in the queue meanwhile
+  - artificial link delay comes from the latency model of the config
+  - the network faults set by tests apply to every message, see faults.go
+  - the config is copied when the transport is created, reloading it
+    does not touch the links of running servers
+  - closing stops every link and waits for them
+*/
+type Transport struct {
+	from   string
+	cfg    u.ServerConfig
+	mu     sync.Mutex
+	rand   *rand.Rand // draws link delays, guarded by mu
+	peers  map[string]*peer
+	wg     sync.WaitGroup // running links
+	closed bool
+}
+
+type outbound struct {
+	payload []byte
+	at      time.Time // earliest delivery time
+}
+
+type peer struct {
+	from    string
+	to      string
+	network string
+	addr    string
+	queue   chan outbound
+	done    chan struct{}
+	mu      sync.Mutex
+	conn    net.Conn // set and cleared by run, guarded by mu
+	lastErr error
+}
+
+func NewTransport(from string) *Transport {
+	t := &Transport{
+		from:  from,
+		cfg:   u.Config,
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+		peers: make(map[string]*peer),
+	}
+	track(from, t)
+	return t
+}
+
+// queues the message for the peer listening on the given server port
+// fails only if the message can not be queued, delivery happens in the background
+func (t *Transport) Send(to string, message []byte) error {
+	p, err := t.peer(to)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	delay := t.cfg.Latency.Delay(t.from, to, t.rand)
+	t.mu.Unlock()
+	out := outbound{
+		payload: message,
+		at:      time.Now().Add(delay),
+	}
+
+	copies, hold := faults.fate(t.from, to)
+	for i := 0; i < copies; i++ {
+		if hold > 0 {
+			// joins the queue late, behind the messages sent meanwhile
+			time.AfterFunc(hold, func() {
+				if err := p.enqueue(out); err != nil {
+					log.Printf("Dropping held back message to %s: %v\n", to, err)
+				}
+			})
+			continue
+		}
+		if err := p.enqueue(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sends the message to every server, including this one if self is set
+func (t *Transport) Broadcast(message []byte, self bool) error {
+	cfg := t.cfg
+	var errs []error
+	for i := 0; i < cfg.NumServers; i++ {
+		to := cfg.ServerPorts[i]
+		if !self && to == t.from {
+			continue
+		}
+		if err := t.Send(to, message); err != nil {
+			errs = append(errs, errors.New(to+": "+err.Error()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// the last delivery failure to the peer, nil once it is reachable again
+// or if nothing was sent to it yet
+func (t *Transport) LastError(to string) error {
+	t.mu.Lock()
+	p, ok := t.peers[to]
+	closed := t.closed
+	t.mu.Unlock()
+	if closed {
+		return ErrTransportClosed
+	}
+	if !ok {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastErr
+}
+
+// stops every link and waits until they are gone
+// queued messages are dropped
+func (t *Transport) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	for _, p := range t.peers {
+		close(p.done)
+		// unblocks a write stuck on a slow peer
+		p.mu.Lock()
+		if p.conn != nil {
+			p.conn.Close()
+		}
+		p.mu.Unlock()
+	}
+	t.mu.Unlock()
+
+	t.wg.Wait()
+	return nil
+}
+
+func (t *Transport) peer(to string) (*peer, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil, ErrTransportClosed
+	}
+	p, ok := t.peers[to]
+	if !ok {
+		p = &peer{
+			from:    t.from,
+			to:      to,
+			network: t.cfg.NetType,
+			addr:    t.cfg.NetAddr + ":" + to,
+			queue:   make(chan outbound, peerQueueSize),
+			done:    make(chan struct{}),
+		}
+		t.peers[to] = p
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			p.run()
+		}()
+	}
+	return p, nil
+}
+
+func (p *peer) enqueue(out outbound) error {
+	select {
+	case p.queue <- out:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// delivers queued messages one at a time, retrying each until it is written
+func (p *peer) run() {
+	defer p.closeConn()
+
+	for {
+		var out outbound
+		select {
+		case <-p.done:
+			return
+		case out = <-p.queue:
+		}
+
+		if wait := time.Until(out.at); wait > 0 {
+			select {
+			case <-p.done:
+				return
+			case <-time.After(wait):
+			}
+		}
+		// a partitioned link holds the message until it heals
+		if !faults.waitLink(p.from, p.to, p.done) {
+			return
+		}
+
+		backoff := minBackoff
+		for {
+			err := p.write(out.payload)
+			p.mu.Lock()
+			p.lastErr = err
+			p.mu.Unlock()
+			if err == nil {
+				break
+			}
+			if err == u.ErrFrameTooLarge {
+				log.Printf("Dropping message to %s: %v\n", p.to, err)
+				break
+			}
+
+			select {
+			case <-p.done:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = time.Duration(math.Min(float64(backoff*2), float64(maxBackoff)))
+		}
+	}
+}
+
+func (p *peer) write(payload []byte) error {
+	p.mu.Lock()
+	conn := p.conn
+	p.mu.Unlock()
+	if conn == nil {
+		var err error
+		conn, err = net.Dial(p.network, p.addr)
+		if err != nil {
+			return err
+		}
+		p.mu.Lock()
+		p.conn = conn
+		p.mu.Unlock()
+	}
+
+	err := u.WriteFrame(conn, payload)
+	if err != nil && err != u.ErrFrameTooLarge {
+		// reconnect on the next attempt
+		p.closeConn()
+	}
+	return err
+}
+
+func (p *peer) closeConn() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
@@ -0,0 +1,108 @@
+package services
+
+import (
+	"dist-kv/protocol"
+	u "dist-kv/utils"
+)
+
+var ErrTxConflict = protocol.Errorf(protocol.Conflict, "transaction conflicts with a later commit")
+var ErrTxDone = protocol.Errorf(protocol.BadRequest, "transaction already committed or aborted")
+
+/*
+	Tx is a transaction with snapshot isolation
+	- reads see the cluster as of Begin, plus the writes of the transaction
+	- writes are buffered on the client and committed as one entry in the
+	  linearizable order, other clients see all of them or none
+	- a commit fails with ErrTxConflict if another transaction committed
+	  a key it writes after its snapshot
+*/
+type Tx struct {
+	client   *Client
+	snapshot int64
+	writes   []u.Write
+	index    map[string]int // position of the last write to each key
+	done     bool
+}
+
+// starts a transaction at a snapshot of everything committed so far
+func (c *Client) Begin() (*Tx, error) {
+	response, err := c.call(c.txPayload(&protocol.Request{Op: "begin"}))
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{client: c, snapshot: response.Snapshot, index: map[string]int{}}, nil
+}
+
+// value of the key at the snapshot, or the value the transaction wrote
+// a missing key reads as the empty value
+func (tx *Tx) Get(key string) (string, error) {
+	if tx.done {
+		return "", ErrTxDone
+	}
+	if i, ok := tx.index[key]; ok {
+		return tx.writes[i].Value, nil
+	}
+
+	response, err := tx.client.call(tx.client.txPayload(&protocol.Request{
+		Op: "txget",
+		Key: key,
+		Snapshot: tx.snapshot,
+	}))
+	if err != nil {
+		return "", err
+	}
+	return response.Value, nil
+}
+
+func (tx *Tx) Set(key, value string) {
+	tx.write(u.Write{Key: key, Value: value})
+}
+
+func (tx *Tx) Delete(key string) {
+	tx.write(u.Write{Key: key, Delete: true})
+}
+
+func (tx *Tx) write(w u.Write) {
+	if i, ok := tx.index[w.Key]; ok {
+		tx.writes[i] = w
+		return
+	}
+	tx.index[w.Key] = len(tx.writes)
+	tx.writes = append(tx.writes, w)
+}
+
+// applies every write of the transaction atomically
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	if len(tx.writes) == 0 {
+		return nil
+	}
+
+	response, err := tx.client.call(tx.client.txPayload(&protocol.Request{
+		Op: "txn",
+		Snapshot: tx.snapshot,
+		Writes: tx.writes,
+	}))
+	if err != nil {
+		return err
+	}
+	if !response.Committed {
+		return ErrTxConflict
+	}
+	return nil
+}
+
+// drops the buffered writes, nothing was sent to the servers yet
+func (tx *Tx) Abort() {
+	tx.done = true
+	tx.writes = nil
+}
+
+// transactions run at the linearizable level on a mixed cluster
+func (c *Client) txPayload(payload *protocol.Request) *protocol.Request {
+	payload.Consistency = LinearizableLevel
+	return payload
+}
@@ -0,0 +1,317 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"dist-kv/protocol"
+	u "dist-kv/utils"
+)
+
+// events a watcher may have queued before it is dropped
+const watchBuffer = 256
+
+var errWatchCompacted = errors.New("resume revision is older than the retained events")
+var errWatchAhead = errors.New("resume revision is ahead of this replica")
+var errWatchBehind = errors.New("watch fell behind")
+
+// a change applied to the store of a replica
+type WatchEvent = protocol.Event
+
+/*
+	Fans the changes of one replica out to its watchers
+	- every change applied to the store gets the next revision and is
+	  appended to the change log of the node
+	- a watcher can resume after the last revision it saw without
+	  missing any, as long as the log still retains it
+	- a watcher that does not keep up is dropped, it can resume
+*/
+type watchHub struct {
+	mu       sync.Mutex
+	revision int64
+	log      *changeLog
+	watchers map[*watcher]bool
+}
+
+type watcher struct {
+	key    string // a single key, or
+	prefix string // every key with the prefix
+	events chan WatchEvent
+	err    error // why the watch ended, set before events is closed
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{
+		log: newChangeLog(u.Config.ChangeLogRetain),
+		watchers: make(map[*watcher]bool),
+	}
+}
+
+// wraps the store so every change it applies is published
+func (h *watchHub) watch(store u.Store) u.Store {
+	return &watchedStore{Store: store, hub: h}
+}
+
+func (w *watcher) matches(key string) bool {
+	if w.key != "" {
+		return key == w.key
+	}
+	return strings.HasPrefix(key, w.prefix)
+}
+
+func (h *watchHub) publish(op, key, value string, version int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.revision++
+	event := WatchEvent{Revision: h.revision, Op: op, Key: key, Value: value, Version: version}
+	h.log.append(event)
+
+	for w := range h.watchers {
+		if !w.matches(key) {
+			continue
+		}
+		select {
+		case w.events <- event:
+		default:
+			h.drop(w, errWatchBehind)
+		}
+	}
+}
+
+// starts a watch on a key or prefix
+// with since > 0 the retained changes after that revision are replayed first
+// returns the revision the watch starts after
+func (h *watchHub) subscribe(key, prefix string, since int64) (*watcher, int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	w := &watcher{key: key, prefix: prefix}
+	var replay []WatchEvent
+	if since > 0 {
+		if since > h.revision {
+			return nil, 0, errWatchAhead
+		}
+		missed, err := h.log.read(since + 1, int(h.revision - since), h.revision)
+		if err != nil {
+			return nil, 0, errWatchCompacted
+		}
+		for _, event := range missed {
+			if w.matches(event.Key) {
+				replay = append(replay, event)
+			}
+		}
+	}
+
+	// the replayed changes must fit next to the live ones
+	w.events = make(chan WatchEvent, watchBuffer + len(replay))
+	for _, event := range replay {
+		w.events <- event
+	}
+
+	h.watchers[w] = true
+	return w, h.revision, nil
+}
+
+// reads the change log, returns the oldest offset it retains too
+func (h *watchHub) changes(offset int64, limit int) ([]WatchEvent, int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	changes, err := h.log.read(offset, limit, h.revision)
+	// copied, the log may drop them once the lock is released
+	return append([]WatchEvent(nil), changes...), h.log.first(h.revision), err
+}
+
+func (h *watchHub) unsubscribe(w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.drop(w, nil)
+}
+
+// callers hold h.mu
+func (h *watchHub) drop(w *watcher, err error) {
+	if !h.watchers[w] {
+		return
+	}
+	delete(h.watchers, w)
+	w.err = err
+	close(w.events)
+}
+
+// a store publishing its changes to a watch hub
+type watchedStore struct {
+	u.Store
+	hub *watchHub
+}
+
+func (s *watchedStore) Set(key, value string) (u.Entry, error) {
+	entry, err := s.Store.Set(key, value)
+	if err == nil {
+		s.hub.publish("set", key, value, entry.Version)
+	}
+	return entry, err
+}
+
+func (s *watchedStore) Put(key, value string, version int64) (bool, error) {
+	ok, err := s.Store.Put(key, value, version)
+	if err == nil && ok {
+		s.hub.publish("set", key, value, version)
+	}
+	return ok, err
+}
+
+func (s *watchedStore) Delete(key string) error {
+	// deleting a missing key changes nothing
+	entry, err := s.Store.Get(key)
+	if err == u.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := s.Store.Delete(key); err != nil {
+		return err
+	}
+	s.hub.publish("del", key, "", entry.Version)
+	return nil
+}
+
+// streams the events of a watch request until it is cancelled
+// format {op: 'watch', key: key, since: revision}
+// format {op: 'watch', prefix: prefix, since: revision}
+func serveWatch(hub *watchHub, message *protocol.Request, send func(*protocol.Reply), cancel <-chan struct{}) {
+	w, revision, err := hub.subscribe(message.Key, message.Prefix, message.Since)
+	if err != nil {
+		send(&protocol.Reply{Error: protocol.Wrap(protocol.BadRequest, err), Done: true})
+		return
+	}
+	defer hub.unsubscribe(w)
+
+	send(&protocol.Reply{Watching: true, Revision: revision})
+	for {
+		select {
+		case event, ok := <-w.events:
+			if !ok {
+				end := &protocol.Reply{Done: true}
+				if w.err != nil {
+					end.Error = protocol.Wrap(protocol.Unavailable, w.err)
+				}
+				send(end)
+				return
+			}
+			send(&protocol.Reply{Event: &event})
+		case <-cancel:
+			send(&protocol.Reply{Done: true})
+			return
+		}
+	}
+}
+
+/*
+	Watch is a stream of the changes applied on the replica of the client
+	- Events is closed when the watch ends, Err tells why
+	- a watch that ended early can be resumed with the revision of the
+	  last event received
+*/
+type Watch struct {
+	Events   <-chan WatchEvent
+	Revision int64 // the watch started after this revision
+
+	pool   *connPool
+	cc     *clientConn // the connection streaming the watch
+	reqId  string
+	closed chan struct{}
+	once   sync.Once
+	mu     sync.Mutex
+	err    error
+}
+
+// watches a key, since > 0 resumes after that revision
+func (c *Client) Watch(key string, since int64) (*Watch, error) {
+	return c.watch(&protocol.Request{Op: "watch", Key: key}, since)
+}
+
+// watches every key with the prefix, since > 0 resumes after that revision
+func (c *Client) WatchPrefix(prefix string, since int64) (*Watch, error) {
+	return c.watch(&protocol.Request{Op: "watch", Prefix: prefix}, since)
+}
+
+func (c *Client) watch(payload *protocol.Request, since int64) (*Watch, error) {
+	payload.Since = since
+	pool := c.connPool()
+	cc, reqId, stream, err := pool.stream(payload, watchBuffer)
+	if err != nil {
+		return nil, connError(err)
+	}
+
+	first, ok := <-stream
+	if !ok {
+		return nil, connError(errConnClosed)
+	}
+	if first.Error != nil {
+		return nil, first.Error
+	}
+
+	events := make(chan WatchEvent, watchBuffer)
+	w := &Watch{Events: events, Revision: first.Revision, pool: pool, cc: cc, reqId: reqId, closed: make(chan struct{})}
+	go w.run(stream, events)
+	return w, nil
+}
+
+func (w *Watch) run(stream chan *protocol.Reply, events chan WatchEvent) {
+	defer close(events)
+	for {
+		message, ok := <-stream
+		if !ok {
+			// the connection broke or the stream was dropped for being slow
+			w.setErr(protocol.Wrap(protocol.Unavailable, errWatchBehind))
+			return
+		}
+		if message.Done {
+			if message.Error != nil {
+				w.setErr(message.Error)
+			}
+			return
+		}
+		if message.Event == nil {
+			continue
+		}
+
+		select {
+		case events <- *message.Event:
+		case <-w.closed:
+			return
+		}
+	}
+}
+
+func (w *Watch) setErr(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	select {
+	case <-w.closed:
+		// a closed watch ends without error
+	default:
+		w.err = err
+	}
+}
+
+// why the watch ended, nil while it runs or once it is closed
+func (w *Watch) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// stops the watch, Events is closed once the server stops streaming
+func (w *Watch) Close() {
+	w.once.Do(func() {
+		w.mu.Lock()
+		close(w.closed)
+		w.mu.Unlock()
+		// the unwatch must go over the connection of the watch
+		w.cc.send(w.pool.nextReqId(), &protocol.Request{Op: "unwatch", Watch: w.reqId})
+	})
+}
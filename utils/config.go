@@ -1,13 +1,34 @@
 package utils
 
+import "path/filepath"
+
 type ServerConfig struct {
 	NetAddr 		string		`json:"netAddr"`
     NetType 		string		`json:"netType"`
-    PayloadSize 	int			`json:"payloadSize"`
+    MaxFrameSize 	int			`json:"maxFrameSize"` // bytes, defaults to 4MB
 	NumServers		int			`json:"numServers"`
     ClientPorts 	[]string	`json:"clientPorts"`
     ServerPorts 	[]string	`json:"serverPorts"`
     KvStorePorts 	[]string	`json:"kvStorePorts"`
+	Storage			string		`json:"storage"` // redis (default), memory or disk
+	DataDir			string		`json:"dataDir"` // disk storage and raft state, defaults to ./data
+	Fsync			string		`json:"fsync"` // always (default), interval or never
+	FsyncIntervalMs	int			`json:"fsyncIntervalMs"`
+	SnapshotEvery	int			`json:"snapshotEvery"` // log records between snapshots
+	QuorumN			int			`json:"quorumN"` // replicas per key, defaults to numServers
+	QuorumR			int			`json:"quorumR"` // replies per read, defaults to a majority of N
+	QuorumW			int			`json:"quorumW"` // acks per write, defaults to a majority of N
+	ChangeLogRetain	int			`json:"changeLogRetain"` // changes kept per node for tailing and watch resumes
+	Latency			LatencyModel	`json:"latency"` // artificial delay between servers, none by default
 }
 
-var Config ServerConfig
\ No newline at end of file
+var Config ServerConfig
+
+// path of the named file or directory in the data directory
+func (c ServerConfig) DataPath(name string) string {
+	dataDir := c.DataDir
+	if dataDir == "" {
+		dataDir = "./data"
+	}
+	return filepath.Join(dataDir, name)
+}
\ No newline at end of file
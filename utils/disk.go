@@ -0,0 +1,402 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FsyncAlways   = "always"   // fsync after every record
+	FsyncInterval = "interval" // fsync every FsyncIntervalMs in the background
+	FsyncNever    = "never"    // leave flushing to the OS
+)
+
+const (
+	walFile      = "wal.log"
+	snapshotFile = "snapshot.json"
+)
+
+// a single record of the write-ahead log
+// records carry the resulting version so replaying them is idempotent
+// a delete carries the version the key had
+type walRecord struct {
+	Op      string `json:"op"`
+	Key     string `json:"key"`
+	Value   string `json:"value,omitempty"`
+	Version int64  `json:"version,omitempty"`
+}
+
+// an entry of the snapshot, deleted keys are kept with their version
+type snapshotEntry struct {
+	Entry
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+/*
+DiskStore is the embedded durable storage engine.
+- Every mutation is appended to a write-ahead log before it is applied in memory
+- Each log line is "<crc32 hex> <json record>" so torn writes are detected
+- Every SnapshotEvery records the state is written to a snapshot and the log is reset
+- On open the snapshot is loaded and the log is replayed on top of it
+- Deleted keys are kept as tombstones with their version, in the log and the snapshot
+*/
+type DiskStore struct {
+	mu      sync.RWMutex
+	dir     string
+	data    map[string]Entry
+	deleted map[string]int64 // versions of the deleted keys
+	wal     *os.File
+	writer  *bufio.Writer
+	fsync   string
+	records int // records appended since the last snapshot
+	every   int
+	done    chan struct{}
+	closed  bool
+}
+
+// opens the store in dir, recovering any state left by a previous run
+func OpenDiskStore(dir string, fsync string, fsyncInterval time.Duration, snapshotEvery int) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if fsync == "" {
+		fsync = FsyncAlways
+	}
+	if fsync != FsyncAlways && fsync != FsyncInterval && fsync != FsyncNever {
+		return nil, fmt.Errorf("unknown fsync policy: %s", fsync)
+	}
+
+	d := &DiskStore{
+		dir:   dir,
+		data:    make(map[string]Entry),
+		deleted: make(map[string]int64),
+		fsync:   fsync,
+		every: snapshotEvery,
+		done:  make(chan struct{}),
+	}
+
+	if err := d.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := d.replay(); err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	d.wal = wal
+	d.writer = bufio.NewWriter(wal)
+
+	if fsync == FsyncInterval {
+		if fsyncInterval <= 0 {
+			fsyncInterval = time.Second
+		}
+		go d.syncLoop(fsyncInterval)
+	}
+
+	return d, nil
+}
+
+func (d *DiskStore) Get(key string) (Entry, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	entry, ok := d.data[key]
+	if !ok {
+		return Entry{}, ErrNotFound
+	}
+	return entry, nil
+}
+
+func (d *DiskStore) Set(key, value string) (Entry, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry := Entry{Key: key, Value: value, Version: d.version(key) + 1}
+	err := d.append(walRecord{Op: "set", Key: key, Value: value, Version: entry.Version})
+	if err != nil {
+		return Entry{}, err
+	}
+	d.data[key] = entry
+	delete(d.deleted, key)
+	return entry, d.maybeSnapshot()
+}
+
+func (d *DiskStore) Put(key, value string, version int64) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.version(key) >= version {
+		return false, nil
+	}
+	err := d.append(walRecord{Op: "set", Key: key, Value: value, Version: version})
+	if err != nil {
+		return false, err
+	}
+	d.data[key] = Entry{Key: key, Value: value, Version: version}
+	delete(d.deleted, key)
+	return true, d.maybeSnapshot()
+}
+
+func (d *DiskStore) Delete(key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, ok := d.data[key]
+	if !ok {
+		return nil
+	}
+	if err := d.append(walRecord{Op: "del", Key: key, Version: entry.Version}); err != nil {
+		return err
+	}
+	delete(d.data, key)
+	d.deleted[key] = entry.Version
+	return d.maybeSnapshot()
+}
+
+func (d *DiskStore) Scan(start, end string, limit int) ([]Entry, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return scanMap(d.data, start, end, limit), nil
+}
+
+// forces a snapshot and resets the write-ahead log
+func (d *DiskStore) Snapshot() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.snapshot()
+}
+
+func (d *DiskStore) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	close(d.done)
+
+	if err := d.writer.Flush(); err != nil {
+		return err
+	}
+	if err := d.wal.Sync(); err != nil {
+		return err
+	}
+	return d.wal.Close()
+}
+
+// the last version of the key, deleted or not
+// callers hold d.mu
+func (d *DiskStore) version(key string) int64 {
+	if entry, ok := d.data[key]; ok {
+		return entry.Version
+	}
+	return d.deleted[key]
+}
+
+// callers hold d.mu
+func (d *DiskStore) append(record walRecord) error {
+	if d.closed {
+		return fmt.Errorf("store is closed")
+	}
+
+	raw, _ := json.Marshal(record)
+	line := fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(raw), raw)
+	if _, err := d.writer.WriteString(line); err != nil {
+		return err
+	}
+
+	if d.fsync == FsyncAlways {
+		if err := d.writer.Flush(); err != nil {
+			return err
+		}
+		if err := d.wal.Sync(); err != nil {
+			return err
+		}
+	} else if d.fsync == FsyncNever {
+		// hand the record to the OS, it decides when to flush
+		if err := d.writer.Flush(); err != nil {
+			return err
+		}
+	}
+
+	d.records++
+	return nil
+}
+
+// callers hold d.mu
+func (d *DiskStore) maybeSnapshot() error {
+	if d.every > 0 && d.records >= d.every {
+		return d.snapshot()
+	}
+	return nil
+}
+
+// writes the snapshot next to the log and atomically swaps it in
+// the log is reset only after the snapshot is durable
+// callers hold d.mu
+func (d *DiskStore) snapshot() error {
+	entries := make([]snapshotEntry, 0, len(d.data)+len(d.deleted))
+	for _, entry := range d.data {
+		entries = append(entries, snapshotEntry{Entry: entry})
+	}
+	for key, version := range d.deleted {
+		entries = append(entries, snapshotEntry{Entry: Entry{Key: key, Version: version}, Deleted: true})
+	}
+	raw, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(d.dir, snapshotFile+".tmp")
+	if err := writeFileSync(tmp, raw); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(d.dir, snapshotFile)); err != nil {
+		return err
+	}
+
+	// the snapshot covers every record, start a fresh log
+	if err := d.writer.Flush(); err != nil {
+		return err
+	}
+	if err := d.wal.Truncate(0); err != nil {
+		return err
+	}
+	if err := d.wal.Sync(); err != nil {
+		return err
+	}
+	d.records = 0
+	return nil
+}
+
+func (d *DiskStore) loadSnapshot() error {
+	raw, err := os.ReadFile(filepath.Join(d.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	entries := make([]snapshotEntry, 0)
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return fmt.Errorf("corrupt snapshot in %s: %v", d.dir, err)
+	}
+	for _, entry := range entries {
+		if entry.Deleted {
+			d.deleted[entry.Key] = entry.Version
+		} else {
+			d.data[entry.Key] = entry.Entry
+		}
+	}
+	return nil
+}
+
+// replays the log on top of the snapshot
+// a torn or corrupt tail (crash in the middle of a write) is cut off
+func (d *DiskStore) replay() error {
+	path := filepath.Join(d.dir, walFile)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Dropping torn record at the end of %s\n", path)
+			}
+			break
+		} else if err != nil {
+			return err
+		}
+
+		record, ok := parseRecord(line)
+		if !ok {
+			log.Printf("Dropping corrupt records after offset %d in %s\n", offset, path)
+			break
+		}
+
+		if record.Op == "set" {
+			d.data[record.Key] = Entry{Key: record.Key, Value: record.Value, Version: record.Version}
+			delete(d.deleted, record.Key)
+		} else if record.Op == "del" {
+			delete(d.data, record.Key)
+			d.deleted[record.Key] = record.Version
+		}
+		offset += int64(len(line))
+		d.records++
+	}
+
+	return os.Truncate(path, offset)
+}
+
+func (d *DiskStore) syncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			d.mu.Lock()
+			if !d.closed {
+				d.writer.Flush()
+				d.wal.Sync()
+			}
+			d.mu.Unlock()
+		}
+	}
+}
+
+func parseRecord(line string) (walRecord, bool) {
+	record := walRecord{}
+	parts := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 2)
+	if len(parts) != 2 {
+		return record, false
+	}
+	if fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(parts[1]))) != parts[0] {
+		return record, false
+	}
+	if err := json.Unmarshal([]byte(parts[1]), &record); err != nil {
+		return record, false
+	}
+	return record, true
+}
+
+func writeFileSync(path string, raw []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(raw); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
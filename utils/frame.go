@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// frames larger than this are rejected when MaxFrameSize is not configured
+const DefaultMaxFrameSize = 4 * 1024 * 1024
+
+var ErrFrameTooLarge = errors.New("frame too large")
+
+/*
+	Every message on a client or peer connection is a frame
+	- 4 byte big endian length of the payload
+	- the payload itself (a JSON object)
+*/
+func WriteFrame(w io.Writer, payload []byte) error {
+	if len(payload) > MaxFrameSize() {
+		return ErrFrameTooLarge
+	}
+
+	frame := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[4:], payload)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// reads exactly one frame, short reads are retried until the frame is complete
+// on ErrFrameTooLarge the stream can not be resynced and must be closed
+func ReadFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header)
+	if int64(size) > int64(MaxFrameSize()) {
+		return nil, ErrFrameTooLarge
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// largest frame accepted or written
+func MaxFrameSize() int {
+	if Config.MaxFrameSize > 0 {
+		return Config.MaxFrameSize
+	}
+	return DefaultMaxFrameSize
+}
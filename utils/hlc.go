@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Timestamp of a hybrid logical clock
+// Wall is physical time in milliseconds, Logical orders events within it
+type Timestamp struct {
+	Wall    int64 `json:"wall"`
+	Logical int64 `json:"logical"`
+}
+
+func (t Timestamp) Less(other Timestamp) bool {
+	if t.Wall != other.Wall {
+		return t.Wall < other.Wall
+	}
+	return t.Logical < other.Logical
+}
+
+// "wall.logical", the form written to the logs
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%d.%d", t.Wall, t.Logical)
+}
+
+/*
+	HLC is a hybrid logical clock
+	- timestamps never go backwards, even if the machine clock does
+	- a timestamp is always greater than every timestamp received before it,
+	  so ordering respects causality across hosts with skewed clocks
+	- while clocks agree timestamps stay close to physical time
+*/
+type HLC struct {
+	mu   sync.Mutex
+	last Timestamp
+	// physical clock in milliseconds, replaceable for tests
+	physical func() int64
+}
+
+func NewHLC() *HLC {
+	return NewHLCWithClock(func() int64 { return time.Now().UnixMilli() })
+}
+
+// an HLC reading physical time in milliseconds from the given function
+func NewHLCWithClock(physical func() int64) *HLC {
+	return &HLC{physical: physical}
+}
+
+// timestamp for a local or send event
+func (c *HLC) Now() Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wall := c.physical()
+	if wall > c.last.Wall {
+		c.last = Timestamp{Wall: wall}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// timestamp for receiving a message stamped with remote
+func (c *HLC) Update(remote Timestamp) Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wall := c.physical()
+	switch {
+	case wall > c.last.Wall && wall > remote.Wall:
+		c.last = Timestamp{Wall: wall}
+	case remote.Wall > c.last.Wall:
+		c.last = Timestamp{Wall: remote.Wall, Logical: remote.Logical + 1}
+	case c.last.Wall > remote.Wall:
+		c.last.Logical++
+	default:
+		// same wall time on both sides
+		if remote.Logical > c.last.Logical {
+			c.last.Logical = remote.Logical
+		}
+		c.last.Logical++
+	}
+	return c.last
+}
@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"math/rand"
+	"time"
+)
+
+// latency distributions, anything else is constant
+const (
+	ConstantLatency = "constant"
+	UniformLatency  = "uniform"
+	NormalLatency   = "normal"
+)
+
+/*
+	LatencyModel is the artificial delay of the links between servers
+	- links are listed by server port or by region name, a region
+	  being a named group of server ports, each port in at most one region
+	- a link applies both ways unless the other direction is listed too
+	- the most specific link wins: port to port, then port and region,
+	  then region to region, then the defaults of the model
+	- a server sending to itself is a link like any other
+	- without a model, or with zero means, there is no artificial delay
+*/
+type LatencyModel struct {
+	MeanMs       float64             `json:"meanMs"` // links not listed
+	JitterMs     float64             `json:"jitterMs"`
+	Distribution string              `json:"distribution"` // constant (default), uniform or normal
+	Regions      map[string][]string `json:"regions"`      // server ports by region name
+	Links        []LinkLatency       `json:"links"`
+}
+
+// LinkLatency is the delay between two servers or regions
+type LinkLatency struct {
+	From         string  `json:"from"` // server port or region name
+	To           string  `json:"to"`
+	MeanMs       float64 `json:"meanMs"`
+	JitterMs     float64 `json:"jitterMs"` // spread around the mean
+	Distribution string  `json:"distribution"` // defaults to the one of the model
+}
+
+// draws the delay of one message from a server port to another
+// uniform stays within the jitter of the mean, normal uses the jitter as
+// standard deviation, neither goes below zero
+func (m *LatencyModel) Delay(from, to string, r *rand.Rand) time.Duration {
+	link := m.link(from, to)
+	mean, jitter := link.MeanMs, link.JitterMs
+
+	ms := mean
+	switch link.Distribution {
+	case UniformLatency:
+		ms = mean + jitter*(2*r.Float64()-1)
+	case NormalLatency:
+		ms = mean + jitter*r.NormFloat64()
+	}
+	if ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// the most specific link between the ports
+func (m *LatencyModel) link(from, to string) LinkLatency {
+	fromRegion, toRegion := m.region(from), m.region(to)
+	pairs := [][2]string{
+		{from, to},
+		{from, toRegion},
+		{fromRegion, to},
+		{fromRegion, toRegion},
+	}
+	for _, pair := range pairs {
+		if pair[0] == "" || pair[1] == "" {
+			continue
+		}
+		if link, ok := m.find(pair[0], pair[1]); ok {
+			if link.Distribution == "" {
+				link.Distribution = m.Distribution
+			}
+			return link
+		}
+	}
+	return LinkLatency{From: from, To: to, MeanMs: m.MeanMs, JitterMs: m.JitterMs, Distribution: m.Distribution}
+}
+
+// the listed link from a to b, or from b to a if only that one is listed
+func (m *LatencyModel) find(a, b string) (LinkLatency, bool) {
+	var reverse *LinkLatency
+	for i, link := range m.Links {
+		if link.From == a && link.To == b {
+			return link, true
+		}
+		if link.From == b && link.To == a && reverse == nil {
+			reverse = &m.Links[i]
+		}
+	}
+	if reverse != nil {
+		return *reverse, true
+	}
+	return LinkLatency{}, false
+}
+
+// region of the server port, empty if it has none
+func (m *LatencyModel) region(port string) string {
+	for name, ports := range m.Regions {
+		for _, p := range ports {
+			if p == port {
+				return name
+			}
+		}
+	}
+	return ""
+}
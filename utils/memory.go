@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"sort"
+	"sync"
+)
+
+// MemoryStore is a pure Go in-memory Store
+// data is lost when the process exits
+type MemoryStore struct {
+	mu   sync.RWMutex
+	data map[string]Entry
+	// versions of the deleted keys, a key set again continues from there
+	deleted map[string]int64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: make(map[string]Entry), deleted: make(map[string]int64)}
+}
+
+func (m *MemoryStore) Get(key string) (Entry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entry, ok := m.data[key]
+	if !ok {
+		return Entry{}, ErrNotFound
+	}
+	return entry, nil
+}
+
+func (m *MemoryStore) Set(key, value string) (Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := Entry{Key: key, Value: value, Version: m.version(key) + 1}
+	m.data[key] = entry
+	delete(m.deleted, key)
+	return entry, nil
+}
+
+func (m *MemoryStore) Put(key, value string, version int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.version(key) >= version {
+		return false, nil
+	}
+	m.data[key] = Entry{Key: key, Value: value, Version: version}
+	delete(m.deleted, key)
+	return true, nil
+}
+
+func (m *MemoryStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if entry, ok := m.data[key]; ok {
+		m.deleted[key] = entry.Version
+		delete(m.data, key)
+	}
+	return nil
+}
+
+func (m *MemoryStore) Scan(start, end string, limit int) ([]Entry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return scanMap(m.data, start, end, limit), nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// the last version of the key, deleted or not
+// callers hold m.mu
+func (m *MemoryStore) version(key string) int64 {
+	if entry, ok := m.data[key]; ok {
+		return entry.Version
+	}
+	return m.deleted[key]
+}
+
+// sorted range scan shared by the map based stores
+func scanMap(data map[string]Entry, start, end string, limit int) []Entry {
+	keys := make([]string, 0)
+	for k := range data {
+		if inRange(k, start, end) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	entries := make([]Entry, 0, len(keys))
+	for _, k := range keys {
+		entries = append(entries, data[k])
+	}
+	return entries
+}
+
+// checks start <= key < end, empty end is unbounded
+func inRange(key, start, end string) bool {
+	return key >= start && (end == "" || key < end)
+}
@@ -0,0 +1,231 @@
+package utils
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrSnapshotTooOld = errors.New("snapshot is older than the retained versions")
+
+// DefaultRetainCommits is how many commits old a snapshot may get
+const DefaultRetainCommits = 10000
+
+// Write is one write of a commit, Delete removes the key
+type Write struct {
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+}
+
+type mvccVersion struct {
+	seq     int64
+	value   string
+	deleted bool
+}
+
+/*
+	MVCC keeps the recent versions of every key over a Store
+	- every commit gets the next sequence number, replicas applying
+	  the same commits in the same order agree on the numbers
+	- a snapshot is a sequence number, reads at it see exactly the
+	  commits up to it
+	- the store always holds the latest version, versions older than
+	  the retained commits are dropped
+*/
+type MVCC struct {
+	mu       sync.RWMutex
+	store    Store
+	seq      int64 // last commit
+	retain   int64
+	versions map[string][]mvccVersion // oldest first
+}
+
+func NewMVCC(store Store, retain int64) *MVCC {
+	return &MVCC{store: store, retain: retain, versions: make(map[string][]mvccVersion)}
+}
+
+// sequence number of the last commit, a snapshot of everything committed
+func (m *MVCC) Seq() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.seq
+}
+
+// applies all writes as one commit and returns its sequence number
+// readers of the MVCC never see part of a commit, a commit failing
+// partway undoes the writes it made
+func (m *MVCC) Commit(writes []Write) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seq := m.seq + 1
+	undo := make([]mvccUndo, 0, len(writes))
+	for _, w := range writes {
+		entry, err := m.store.Get(w.Key)
+		found := err == nil
+		if err != nil && err != ErrNotFound {
+			m.undo(undo)
+			return 0, err
+		}
+		versions, tracked := m.versions[w.Key]
+		if err := m.write(w, seq); err != nil {
+			m.undo(undo)
+			return 0, err
+		}
+		undo = append(undo, mvccUndo{key: w.Key, entry: entry, found: found, versions: len(versions), tracked: tracked})
+	}
+	m.seq = seq
+
+	// pruned against the new sequence number, older versions go right away
+	for _, w := range writes {
+		m.prune(w.Key)
+	}
+	// keys that are no longer written still shed their old versions
+	if m.retain > 0 && seq % m.retain == 0 {
+		for key := range m.versions {
+			m.prune(key)
+		}
+	}
+	return seq, nil
+}
+
+// a key as it was before a commit wrote it
+type mvccUndo struct {
+	key      string
+	entry    Entry
+	found    bool
+	versions int  // number of versions kept for the key
+	tracked  bool // the key had versions
+}
+
+// restores the keys a failed commit wrote, newest write first
+// restored keys are written again, their store versions move on
+// callers hold m.mu
+func (m *MVCC) undo(undo []mvccUndo) {
+	for i := len(undo) - 1; i >= 0; i-- {
+		k := undo[i]
+		if k.found {
+			m.store.Set(k.key, k.entry.Value)
+		} else {
+			m.store.Delete(k.key)
+		}
+		if k.tracked {
+			m.versions[k.key] = m.versions[k.key][:k.versions]
+		} else {
+			delete(m.versions, k.key)
+		}
+	}
+}
+
+// applies a write made outside of the commits, by another protocol sharing the store
+// it gets no sequence number of its own, snapshots after the next commit see it
+// replicas may apply such writes at different points, their snapshots differ in them
+func (m *MVCC) Apply(w Write) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.write(w, m.seq + 1); err != nil {
+		return err
+	}
+	m.prune(w.Key)
+	return nil
+}
+
+// writes to the store and keeps the version, snapshots from seq on see it
+// a failed write leaves the store and the versions as they were
+// callers hold m.mu
+func (m *MVCC) write(w Write, seq int64) error {
+	versions, tracked := m.versions[w.Key]
+	if !tracked {
+		// the first tracked write keeps the stored value for older snapshots
+		base := mvccVersion{deleted: true}
+		entry, err := m.store.Get(w.Key)
+		if err == nil {
+			base = mvccVersion{value: entry.Value}
+		} else if err != ErrNotFound {
+			return err
+		}
+		versions = []mvccVersion{base}
+	}
+
+	var err error
+	if w.Delete {
+		err = m.store.Delete(w.Key)
+	} else {
+		_, err = m.store.Set(w.Key, w.Value)
+	}
+	if err != nil {
+		return err
+	}
+	m.versions[w.Key] = append(versions, mvccVersion{seq: seq, value: w.Value, deleted: w.Delete})
+	return nil
+}
+
+// value of the key at the snapshot, false if it did not exist then
+func (m *MVCC) ReadAt(key string, snapshot int64) (string, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.tooOld(snapshot) {
+		return "", false, ErrSnapshotTooOld
+	}
+
+	versions, ok := m.versions[key]
+	if !ok {
+		// not written within the retained commits, the store has it
+		entry, err := m.store.Get(key)
+		if err == ErrNotFound {
+			return "", false, nil
+		}
+		return entry.Value, err == nil, err
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].seq <= snapshot {
+			return versions[i].value, !versions[i].deleted, nil
+		}
+	}
+	return "", false, ErrSnapshotTooOld
+}
+
+// true if a commit after the snapshot wrote the key
+func (m *MVCC) ChangedSince(key string, snapshot int64) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.tooOld(snapshot) {
+		return false, ErrSnapshotTooOld
+	}
+	versions := m.versions[key]
+	return len(versions) > 0 && versions[len(versions) - 1].seq > snapshot, nil
+}
+
+// callers hold m.mu
+func (m *MVCC) tooOld(snapshot int64) bool {
+	return m.retain > 0 && snapshot < m.seq - m.retain
+}
+
+// drops the versions no retained snapshot can read
+// callers hold m.mu
+func (m *MVCC) prune(key string) {
+	if m.retain <= 0 {
+		return
+	}
+	oldest := m.seq - m.retain
+	versions := m.versions[key]
+
+	// the newest version at or before the oldest snapshot is still visible
+	keep := 0
+	for i := range versions {
+		if versions[i].seq <= oldest {
+			keep = i
+		}
+	}
+	versions = versions[keep:]
+
+	if len(versions) == 1 && versions[0].seq <= oldest {
+		// every snapshot reads the latest version from the store
+		delete(m.versions, key)
+		return
+	}
+	m.versions[key] = versions
+}
@@ -3,37 +3,41 @@ package utils
 import "fmt"
 
 // An Item is something we manage in a priority queue.
-type Item struct {
-	Message map[string]string // The value of the item; arbitrary.
-	Priority float64    // The priority of the item in the queue.
+type Item[T any] struct {
+	Message T // The value of the item; arbitrary.
+	Timestamp Timestamp // The priority of the item in the queue.
+	Node string // Breaks ties between equal timestamps of different nodes.
 	// The index is needed by update and is maintained by the heap.Interface methods.
 	index int // The index of the item in the heap.
 }
 
 // A PriorityQueue implements heap.Interface and holds Items.
-type PriorityQueue []*Item
+type PriorityQueue[T any] []*Item[T]
 
-func (pq PriorityQueue) Len() int { return len(pq) }
+func (pq PriorityQueue[T]) Len() int { return len(pq) }
 
-func (pq PriorityQueue) Less(i, j int) bool {
-	// Lowest priority first, so use less than
-	return pq[i].Priority < pq[j].Priority
+func (pq PriorityQueue[T]) Less(i, j int) bool {
+	// Lowest timestamp first, so use less than
+	if pq[i].Timestamp != pq[j].Timestamp {
+		return pq[i].Timestamp.Less(pq[j].Timestamp)
+	}
+	return pq[i].Node < pq[j].Node
 }
 
-func (pq PriorityQueue) Swap(i, j int) {
+func (pq PriorityQueue[T]) Swap(i, j int) {
 	pq[i], pq[j] = pq[j], pq[i]
 	pq[i].index = i
 	pq[j].index = j
 }
 
-func (pq *PriorityQueue) Push(x any) {
+func (pq *PriorityQueue[T]) Push(x any) {
 	n := len(*pq)
-	item := x.(*Item)
+	item := x.(*Item[T])
 	item.index = n
 	*pq = append(*pq, item)
 }
 
-func (pq *PriorityQueue) Pop() any {
+func (pq *PriorityQueue[T]) Pop() any {
 	old := *pq
 	n := len(old)
 	item := old[n-1]
@@ -43,7 +47,7 @@ func (pq *PriorityQueue) Pop() any {
 	return item
 }
 
-func (pq *PriorityQueue) Print() {
+func (pq *PriorityQueue[T]) Print() {
 	for i := 0; i < pq.Len(); i++ {
 		arr := *pq
 		fmt.Printf("%v ", arr[i])
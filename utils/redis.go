@@ -4,6 +4,8 @@ import (
 	"context"
 	"log"
 	"os/exec"
+	"sort"
+	"strconv"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -38,4 +40,103 @@ func KillRedisClient(port string) {
 	if err != nil {
 		log.Printf("Issue with killing redis server on: %s\n", port)
 	}
-}
\ No newline at end of file
+}
+
+// RedisStore keeps every key as a hash of {value, version}
+// inside the redis server started by StartRedisClient
+// a deleted key keeps the hash with only its version
+type RedisStore struct {
+	ctx    context.Context
+	client *redis.Client
+	port   string
+}
+
+// a store over the client of the redis server on the given port
+// closing it shuts the server down
+func NewRedisStore(ctx context.Context, client *redis.Client, port string) *RedisStore {
+	return &RedisStore{ctx: ctx, client: client, port: port}
+}
+
+func (r *RedisStore) Get(key string) (Entry, error) {
+	fields, err := r.client.HGetAll(r.ctx, key).Result()
+	if err != nil {
+		return Entry{}, err
+	}
+	if _, ok := fields["value"]; !ok {
+		return Entry{}, ErrNotFound
+	}
+
+	version, _ := strconv.ParseInt(fields["version"], 10, 64)
+	return Entry{Key: key, Value: fields["value"], Version: version}, nil
+}
+
+func (r *RedisStore) Set(key, value string) (Entry, error) {
+	var incr *redis.IntCmd
+	_, err := r.client.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(r.ctx, key, "value", value)
+		incr = pipe.HIncrBy(r.ctx, key, "version", 1)
+		return nil
+	})
+	if err != nil {
+		return Entry{}, err
+	}
+	return Entry{Key: key, Value: value, Version: incr.Val()}, nil
+}
+
+// compares and writes in one step on the redis server
+var putScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], 'version')
+if current and tonumber(current) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'value', ARGV[1], 'version', ARGV[2])
+return 1
+`)
+
+func (r *RedisStore) Put(key, value string, version int64) (bool, error) {
+	applied, err := putScript.Run(r.ctx, r.client, []string{key}, value, version).Int()
+	if err != nil {
+		return false, err
+	}
+	return applied == 1, nil
+}
+
+func (r *RedisStore) Delete(key string) error {
+	return r.client.HDel(r.ctx, key, "value").Err()
+}
+
+func (r *RedisStore) Scan(start, end string, limit int) ([]Entry, error) {
+	keys := make([]string, 0)
+	iter := r.client.Scan(r.ctx, 0, "*", 0).Iterator()
+	for iter.Next(r.ctx) {
+		if inRange(iter.Val(), start, end) {
+			keys = append(keys, iter.Val())
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	entries := make([]Entry, 0)
+	for _, k := range keys {
+		if limit > 0 && len(entries) == limit {
+			break
+		}
+		entry, err := r.Get(k)
+		if err == ErrNotFound {
+			// deleted, the hash keeps only its version
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (r *RedisStore) Close() error {
+	r.client.Close()
+	KillRedisClient(r.port)
+	return nil
+}
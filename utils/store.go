@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// returned by Store.Get when the key does not exist
+var ErrNotFound = errors.New("key not found")
+
+// A versioned key value pair held by a Store
+type Entry struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Version int64  `json:"version"`
+}
+
+// Store is the storage engine behind every replica.
+// Every Set bumps the version of the key by one, starting at 1.
+// A deleted key keeps its version, setting it again continues from there.
+type Store interface {
+	Get(key string) (Entry, error)
+	Set(key, value string) (Entry, error)
+	// stores the value at the given version unless the key already
+	// holds the same or a newer one (last writer wins)
+	Put(key, value string, version int64) (bool, error)
+	Delete(key string) error
+	// returns entries with start <= key < end in key order
+	// empty end means no upper bound, limit <= 0 means no limit
+	Scan(start, end string, limit int) ([]Entry, error)
+	Close() error
+}
+
+const (
+	RedisStorage  = "redis"
+	MemoryStorage = "memory"
+	DiskStorage   = "disk"
+)
+
+var storesMu sync.Mutex
+var stores = map[string]Store{}
+
+// starts the storage engine selected in config.json on the given port
+func StartStore(ctx context.Context, port string) (Store, error) {
+	var store Store
+
+	switch Config.Storage {
+	case "", RedisStorage:
+		client, err := StartRedisClient(ctx, port)
+		if err != nil {
+			return nil, err
+		}
+		store = NewRedisStore(ctx, client, port)
+	case MemoryStorage:
+		store = NewMemoryStore()
+	case DiskStorage:
+		interval := time.Duration(Config.FsyncIntervalMs) * time.Millisecond
+		disk, err := OpenDiskStore(Config.DataPath(port), Config.Fsync, interval, Config.SnapshotEvery)
+		if err != nil {
+			return nil, err
+		}
+		store = disk
+	default:
+		return nil, fmt.Errorf("unknown storage engine: %s", Config.Storage)
+	}
+
+	storesMu.Lock()
+	stores[port] = store
+	storesMu.Unlock()
+
+	return store, nil
+}
+
+// closes the store started on the given port
+func StopStore(port string) {
+	storesMu.Lock()
+	store, ok := stores[port]
+	delete(stores, port)
+	storesMu.Unlock()
+
+	if ok {
+		store.Close()
+	}
+}
@@ -0,0 +1,93 @@
+package utils
+
+import "container/heap"
+
+/*
+	Expirations tracks when keys expire, in wall milliseconds
+	- expiry times come from the ordering timestamps of the writes that
+	  set them, not from the clock of the replica, so every replica
+	  expires a key at the same point of the order
+	- not safe for concurrent use, callers hold the lock of their protocol
+*/
+type Expirations struct {
+	at  map[string]int64
+	due expiryHeap // may hold stale entries, checked against at
+}
+
+func NewExpirations() *Expirations {
+	return &Expirations{at: make(map[string]int64)}
+}
+
+// the key expires at the given wall time
+func (e *Expirations) Set(key string, at int64) {
+	e.at[key] = at
+	heap.Push(&e.due, expiry{key: key, at: at})
+}
+
+// the key no longer expires, true if it had an expiry
+func (e *Expirations) Clear(key string) bool {
+	_, ok := e.at[key]
+	delete(e.at, key)
+	return ok
+}
+
+// wall time the key expires at, false if it does not expire
+func (e *Expirations) Get(key string) (int64, bool) {
+	at, ok := e.at[key]
+	return at, ok
+}
+
+func (e *Expirations) Expired(key string, now int64) bool {
+	at, ok := e.at[key]
+	return ok && at <= now
+}
+
+// the earliest wall time a key expires at, false if no key expires
+func (e *Expirations) Next() (int64, bool) {
+	for e.due.Len() > 0 {
+		next := e.due[0]
+		if at, ok := e.at[next.key]; ok && at == next.at {
+			return next.at, true
+		}
+		heap.Pop(&e.due)
+	}
+	return 0, false
+}
+
+// removes and returns the keys expired at the given wall time
+func (e *Expirations) Due(now int64) []string {
+	var keys []string
+	for e.due.Len() > 0 && e.due[0].at <= now {
+		next := heap.Pop(&e.due).(expiry)
+		// a later Set or Clear replaced this entry
+		if at, ok := e.at[next.key]; !ok || at != next.at {
+			continue
+		}
+		delete(e.at, next.key)
+		keys = append(keys, next.key)
+	}
+	return keys
+}
+
+type expiry struct {
+	key string
+	at  int64
+}
+
+type expiryHeap []expiry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at < h[j].at }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *expiryHeap) Push(x any) {
+	*h = append(*h, x.(expiry))
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
@@ -0,0 +1,45 @@
+package utils
+
+// VectorClock counts the writes seen from every server, keyed by server port
+type VectorClock map[string]int64
+
+func (vc VectorClock) Copy() VectorClock {
+	cp := make(VectorClock, len(vc))
+	for k, v := range vc {
+		cp[k] = v
+	}
+	return cp
+}
+
+// raises every entry to the maximum of both clocks
+func (vc VectorClock) Merge(other VectorClock) {
+	for k, v := range other {
+		if v > vc[k] {
+			vc[k] = v
+		}
+	}
+}
+
+// true if vc has seen everything other has seen
+func (vc VectorClock) Descends(other VectorClock) bool {
+	for k, v := range other {
+		if vc[k] < v {
+			return false
+		}
+	}
+	return true
+}
+
+// true if neither clock has seen everything the other has seen
+func (vc VectorClock) Concurrent(other VectorClock) bool {
+	return !vc.Descends(other) && !other.Descends(vc)
+}
+
+// total number of writes seen, grows along every causal chain
+func (vc VectorClock) Sum() int64 {
+	var sum int64
+	for _, v := range vc {
+		sum += v
+	}
+	return sum
+}